@@ -0,0 +1,481 @@
+package discordarchive
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Necroforger/discordarchive/discordtest"
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var (
+	_ DiscordClient  = (*discordgo.Session)(nil)
+	_ DiscordClient  = (*discordtest.Fake)(nil)
+	_ reactionClient = (*discordtest.Fake)(nil)
+)
+
+// testGuild returns a fake guild with two text channels of 250 and 30
+// messages, a voice channel without messages and three members.
+func testGuild() (*discordtest.Fake, []*discordgo.Channel) {
+	f := discordtest.NewFake()
+	f.AddGuild(&discordgo.Guild{ID: "81384788765712384", Name: "guild"})
+
+	author := &discordgo.User{ID: "80351110224678912", Username: "author"}
+	channels := []*discordgo.Channel{
+		{ID: "81384788765712385", GuildID: "81384788765712384", Name: "general", Type: discordgo.ChannelTypeGuildText},
+		{ID: "81384788765712386", GuildID: "81384788765712384", Name: "news", Type: discordgo.ChannelTypeGuildNews, Position: 1},
+		{ID: "81384788765712387", GuildID: "81384788765712384", Name: "voice", Type: discordgo.ChannelTypeGuildVoice, Position: 2},
+	}
+	for _, channel := range channels {
+		f.AddChannel(channel)
+	}
+	f.AddMessages(discordtest.Messages(channels[0], author, 0, 250)...)
+	f.AddMessages(discordtest.Messages(channels[1], author, 0, 30)...)
+
+	for _, usr := range []*discordgo.User{author, {ID: "80351110224678913"}, {ID: "80351110224678914"}} {
+		f.AddMembers("81384788765712384", &discordgo.Member{User: usr})
+	}
+	return f, channels
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "archive.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// archiveGuild archives the guild and members of testGuild to db.
+func archiveGuild(t *testing.T, s DiscordClient, db *sql.DB, opt *Options) {
+	a := New()
+	defer a.Close()
+
+	sink, err := NewDBSink(a, db, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.ArchiveGuildTo(s, sink, "81384788765712384", opt)
+	if err == nil {
+		err = a.ArchiveMembersTo(s, sink, "81384788765712384", opt)
+	}
+	a.Wait()
+	if cerr := sink.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectCount(t *testing.T, db *sql.DB, want int, query string, args ...interface{}) {
+	t.Helper()
+	n, err := Count(db, query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != want {
+		t.Fatalf("%s: got %d, want %d", query, n, want)
+	}
+}
+
+func TestArchiveGuild(t *testing.T) {
+	f, channels := testGuild()
+	db := openTestDB(t)
+
+	opt := NewOptions()
+	opt.ChannelConcurrency = 2
+	archiveGuild(t, f, db, opt)
+
+	expectCount(t, db, 1, "SELECT count(*) FROM guilds")
+	expectCount(t, db, 3, "SELECT count(*) FROM channels")
+	expectCount(t, db, 250, "SELECT count(*) FROM messages WHERE channelID=?", channels[0].ID)
+	expectCount(t, db, 30, "SELECT count(*) FROM messages WHERE channelID=?", channels[1].ID)
+	expectCount(t, db, 3, "SELECT count(*) FROM members")
+	expectCount(t, db, 0, "SELECT count(*) FROM checkpoints")
+
+	// Only the new messages are fetched when updating.
+	f.AddMessages(discordtest.Messages(channels[0], &discordgo.User{ID: "80351110224678912"}, 250, 120)...)
+	opt.Update = true
+	archiveGuild(t, f, db, opt)
+	expectCount(t, db, 370, "SELECT count(*) FROM messages WHERE channelID=?", channels[0].ID)
+
+	msg, err := Message(db, channels[0].ID, discordtest.Messages(channels[0], nil, 369, 1)[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Content != "message 369" {
+		t.Fatalf("got newest message %q, want %q", msg.Content, "message 369")
+	}
+}
+
+func TestArchiveGuildServer(t *testing.T) {
+	f, channels := testGuild()
+	srv := discordtest.NewServer(f)
+	defer srv.Close()
+	srv.RateLimitEvery = 3
+
+	db := openTestDB(t)
+	opt := NewOptions()
+	opt.ChannelConcurrency = 2
+	archiveGuild(t, srv.Session(), db, opt)
+
+	expectCount(t, db, 3, "SELECT count(*) FROM channels")
+	expectCount(t, db, 250, "SELECT count(*) FROM messages WHERE channelID=?", channels[0].ID)
+	expectCount(t, db, 30, "SELECT count(*) FROM messages WHERE channelID=?", channels[1].ID)
+	expectCount(t, db, 3, "SELECT count(*) FROM members")
+	if srv.RateLimited() == 0 {
+		t.Fatal("no requests were rate limited")
+	}
+}
+
+func TestReconcileChannel(t *testing.T) {
+	f, channels := testGuild()
+	db := openTestDB(t)
+	archiveGuild(t, f, db, NewOptions())
+
+	msgs, _ := f.ChannelMessages(channels[1].ID, 2, "", "", "")
+	f.DeleteMessage(channels[1].ID, msgs[1].ID)
+	msgs[0].Content = "edited"
+	// Discord sends edit times with microseconds.
+	editedAt := time.Date(2021, 6, 1, 14, 32, 46, 104497000, time.UTC)
+	msgs[0].EditedTimestamp = &editedAt
+	f.AddMessages(msgs[0])
+
+	a := New()
+	defer a.Close()
+	reconcile := func() *ReconcileResult {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := a.ReconcileChannelContext(context.Background(), f, tx, channels[1].ID)
+		if err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+		if err = tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := reconcile()
+	if res.Deleted != 1 || res.Edited != 1 {
+		t.Fatalf("got %d deleted and %d edited messages, want 1 of each", res.Deleted, res.Edited)
+	}
+	if deletedAt, _ := MessageDeletedAt(db, channels[1].ID, msgs[1].ID); deletedAt.IsZero() {
+		t.Fatalf("message %s was not marked as deleted", msgs[1].ID)
+	}
+	stored, err := Message(db, channels[1].ID, msgs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.EditedTimestamp == nil || !stored.EditedTimestamp.Equal(editedAt) {
+		t.Fatalf("got edit time %v, want %s", stored.EditedTimestamp, editedAt)
+	}
+
+	// Reconciling again finds nothing new.
+	res = reconcile()
+	if res.Deleted != 0 || res.Edited != 0 {
+		t.Fatalf("reconciling again got %d deleted and %d edited messages, want none", res.Deleted, res.Edited)
+	}
+	expectCount(t, db, 1, "SELECT count(*) FROM message_revisions WHERE messageID=?", msgs[0].ID)
+}
+
+// threadFake adds the thread endpoints to a Fake, counting the
+// requests for the active threads of a guild.
+type threadFake struct {
+	*discordtest.Fake
+	active        []*discordgo.Channel
+	activeLookups int32
+}
+
+func (f *threadFake) GuildThreadsActive(guildID string, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error) {
+	atomic.AddInt32(&f.activeLookups, 1)
+	return &discordgo.ThreadsList{Threads: f.active}, nil
+}
+
+func (f *threadFake) ThreadsArchived(channelID string, before *time.Time, limit int, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error) {
+	return &discordgo.ThreadsList{}, nil
+}
+
+func (f *threadFake) ThreadsPrivateArchived(channelID string, before *time.Time, limit int, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error) {
+	return &discordgo.ThreadsList{}, nil
+}
+
+func TestArchiveThreads(t *testing.T) {
+	fake, channels := testGuild()
+	f := &threadFake{Fake: fake}
+	for i, parent := range channels[:2] {
+		thread := &discordgo.Channel{
+			ID:       discordtest.Snowflake(discordtest.Epoch, parent.ID+"thread"),
+			GuildID:  parent.GuildID,
+			ParentID: parent.ID,
+			Name:     "thread " + strconv.Itoa(i),
+			Type:     discordgo.ChannelTypeGuildPublicThread,
+		}
+		f.active = append(f.active, thread)
+		f.AddChannel(thread)
+		f.AddMessages(discordtest.Messages(thread, &discordgo.User{ID: "80351110224678912"}, 0, 5)...)
+	}
+	// Threads that can not be read fail to archive.
+	missing := &discordgo.Channel{ID: "81384788765712399", GuildID: channels[0].GuildID, ParentID: channels[0].ID, Name: "missing"}
+	f.active = append(f.active, missing)
+
+	// A forum post whose starter message was deleted is archived without it.
+	forum := &discordgo.Channel{ID: "81384788765712390", GuildID: channels[0].GuildID, Name: "forum", Type: discordgo.ChannelTypeGuildForum, Position: 3}
+	post := &discordgo.Channel{
+		ID:       discordtest.Snowflake(discordtest.Epoch, forum.ID+"post"),
+		GuildID:  forum.GuildID,
+		ParentID: forum.ID,
+		Name:     "post",
+		Type:     discordgo.ChannelTypeGuildPublicThread,
+	}
+	f.AddChannel(forum)
+	f.AddChannel(post)
+	f.AddMessages(discordtest.Messages(post, &discordgo.User{ID: "80351110224678912"}, 1, 3)...)
+	f.active = append(f.active, post)
+
+	db := openTestDB(t)
+	a := New()
+	defer a.Close()
+	sink, err := NewDBSink(a, db, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := NewOptions()
+	opt.IncludeThreads = true
+	opt.ChannelConcurrency = 2
+	err = a.ArchiveGuildTo(f, sink, "81384788765712384", opt)
+	if cerr := sink.Close(); cerr != nil {
+		t.Fatal(cerr)
+	}
+
+	errs, ok := err.(ChannelErrors)
+	if !ok || len(errs) != 1 || errs[0].ChannelID != missing.ID {
+		t.Fatalf("got error %v, want the error of thread %s", err, missing.ID)
+	}
+	if f.activeLookups != 1 {
+		t.Fatalf("active threads were listed %d times, want once per guild", f.activeLookups)
+	}
+	for _, thread := range f.active[:2] {
+		expectCount(t, db, 5, "SELECT count(*) FROM messages WHERE channelID=?", thread.ID)
+	}
+	expectCount(t, db, 3, "SELECT count(*) FROM messages WHERE channelID=?", post.ID)
+}
+
+func TestArchiveDirectMessages(t *testing.T) {
+	f := discordtest.NewFake()
+	me := &discordgo.User{ID: "80351110224678912", Username: "me"}
+	friend := &discordgo.User{ID: "80351110224678913", Username: "friend"}
+	other := &discordgo.User{ID: "80351110224678914", Username: "other"}
+	channels := []*discordgo.Channel{
+		{ID: "81384788765712390", Type: discordgo.ChannelTypeDM, Recipients: []*discordgo.User{friend}},
+		{ID: "81384788765712391", Type: discordgo.ChannelTypeGroupDM, Name: "group", Icon: "abc", Recipients: []*discordgo.User{friend, other}},
+	}
+	for _, channel := range channels {
+		f.AddChannel(channel)
+		f.AddMessages(discordtest.Messages(channel, me, 0, 5)...)
+	}
+
+	db := openTestDB(t)
+	a := New()
+	defer a.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.ArchiveDirectMessages(f, tx, NewOptions(), channels[0].ID, "81384788765712392", channels[1].ID)
+	if cerr := tx.Commit(); cerr != nil {
+		t.Fatal(cerr)
+	}
+
+	// A channel that cannot be archived is reported without stopping the rest.
+	errs, ok := err.(ChannelErrors)
+	if !ok || len(errs) != 1 || errs[0].ChannelID != "81384788765712392" {
+		t.Fatalf("got error %v, want the missing channel", err)
+	}
+	expectCount(t, db, 10, "SELECT count(*) FROM messages")
+
+	dms, err := DirectMessageChannels(db)
+	if err != nil || len(dms) != 2 {
+		t.Fatalf("got %d direct message channels: %v", len(dms), err)
+	}
+	group, err := Channel(db, channels[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.Name != "group" || group.Icon != "abc" {
+		t.Fatalf("got group %q with icon %q, want %q with icon %q", group.Name, group.Icon, "group", "abc")
+	}
+	recipients, err := Recipients(db, channels[1].ID)
+	if err != nil || len(recipients) != 2 {
+		t.Fatalf("got %d recipients of the group: %v", len(recipients), err)
+	}
+	expectCount(t, db, 1, "SELECT count(*) FROM recipients WHERE channelID=? AND userID=?", channels[0].ID, friend.ID)
+	expectCount(t, db, 1, "SELECT count(*) FROM users WHERE userID=? AND username='other'", other.ID)
+}
+
+// channelClient is a client that only implements DiscordClient.
+type channelClient struct {
+	DiscordClient
+}
+
+func TestArchiveReactionUsers(t *testing.T) {
+	f, channels := testGuild()
+	msgs := discordtest.Messages(channels[1], &discordgo.User{ID: "80351110224678912"}, 30, 2)
+	emoji := &discordgo.Emoji{Name: "👍"}
+	users := make([]*discordgo.User, 150)
+	for i := range users {
+		users[i] = &discordgo.User{ID: strconv.Itoa(80351110224679000 + i), Username: "user" + strconv.Itoa(i)}
+	}
+	msgs[0].Reactions = []*discordgo.MessageReactions{{Emoji: emoji, Count: len(users)}}
+	f.AddMessages(msgs...)
+	f.AddReactionUsers(msgs[0].ID, emoji.APIName(), users...)
+
+	opt := NewOptions()
+	opt.SaveReactionUsers = true
+	db := openTestDB(t)
+	archiveGuild(t, f, db, opt)
+
+	// The users are listed 100 at a time.
+	got, err := ReactionUsers(db, channels[1].ID, msgs[0].ID, emoji)
+	if err != nil || len(got) != len(users) {
+		t.Fatalf("got %d reaction users, want %d: %v", len(got), len(users), err)
+	}
+	expectCount(t, db, 0, "SELECT count(*) FROM reaction_users WHERE messageID=?", msgs[1].ID)
+	expectCount(t, db, 1, "SELECT count(*) FROM users WHERE userID=? AND username='user149'", users[149].ID)
+
+	// Clients that can not list reaction users fail instead of skipping them.
+	a := New()
+	defer a.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	err = a.ArchiveChannel(channelClient{f}, tx, channels[1].ID, opt)
+	if err != ErrUnsupportedClient {
+		t.Fatalf("got error %v, want ErrUnsupportedClient", err)
+	}
+}
+
+// pageClient records the pages of messages requested from a Fake.
+type pageClient struct {
+	*discordtest.Fake
+	pages []string
+}
+
+func (c *pageClient) ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string, options ...discordgo.RequestOption) ([]*discordgo.Message, error) {
+	c.pages = append(c.pages, "before="+beforeID+" after="+afterID)
+	return c.Fake.ChannelMessages(channelID, limit, beforeID, afterID, aroundID, options...)
+}
+
+func TestArchiveChannelUpdate(t *testing.T) {
+	f, channels := testGuild()
+	c := &pageClient{Fake: f}
+	db := openTestDB(t)
+	a := New()
+	defer a.Close()
+
+	archive := func(opt *Options) error {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = a.ArchiveChannel(c, tx, channels[1].ID, opt)
+		if cerr := tx.Commit(); cerr != nil {
+			t.Fatal(cerr)
+		}
+		return err
+	}
+	if err := archive(NewOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	newer := discordtest.Messages(channels[1], &discordgo.User{ID: "80351110224678912"}, 30, 20)
+	f.AddMessages(newer...)
+	oldest := discordtest.Messages(channels[1], nil, 0, 1)[0]
+	newest := discordtest.Messages(channels[1], nil, 29, 1)[0]
+
+	// Only the page of messages newer than the newest stored one is fetched.
+	c.pages = nil
+	opt := NewOptions()
+	opt.Update = true
+	if err := archive(opt); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"before= after=" + newest.ID,
+		"before= after=" + newer[len(newer)-1].ID,
+	}
+	if strings.Join(c.pages, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got pages\n%s\nwant\n%s", strings.Join(c.pages, "\n"), strings.Join(want, "\n"))
+	}
+	expectCount(t, db, 50, "SELECT count(*) FROM messages WHERE channelID=?", channels[1].ID)
+
+	// Update would ignore where Skip and LastID start from.
+	opt.LastID = oldest.ID
+	if err := archive(opt); err != ErrUpdateWithOffset {
+		t.Fatalf("got error %v with LastID, want ErrUpdateWithOffset", err)
+	}
+	opt.LastID = ""
+	opt.Skip = 10
+	if err := archive(opt); err != ErrUpdateWithOffset {
+		t.Fatalf("got error %v with Skip, want ErrUpdateWithOffset", err)
+	}
+}
+
+// TestArchiveChannelResume stops archiving a channel at a limit,
+// and checks that the next run resumes from its checkpoint.
+func TestArchiveChannelResume(t *testing.T) {
+	f, channels := testGuild()
+	c := &pageClient{Fake: f}
+	db := openTestDB(t)
+	a := New()
+	defer a.Close()
+
+	archive := func(opt *Options) {
+		sink, err := NewDBSink(a, db, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = a.ArchiveChannelTo(c, sink, channels[0].ID, opt)
+		if cerr := sink.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opt := NewOptions()
+	opt.Limit = 150
+	archive(opt)
+	expectCount(t, db, 150, "SELECT count(*) FROM messages WHERE channelID=?", channels[0].ID)
+
+	// The newest 150 messages were archived, down to message 100.
+	last := discordtest.Messages(channels[0], nil, 100, 1)[0]
+	var lastID string
+	err := db.QueryRow("SELECT lastID FROM checkpoints WHERE channelID=?", channels[0].ID).Scan(&lastID)
+	if err != nil || lastID != last.ID {
+		t.Fatalf("got checkpoint %q, want %q: %v", lastID, last.ID, err)
+	}
+
+	c.pages = nil
+	archive(NewOptions())
+	if len(c.pages) == 0 || c.pages[0] != "before="+last.ID+" after=" {
+		t.Fatalf("got pages %q, want the first before %s", c.pages, last.ID)
+	}
+	expectCount(t, db, 250, "SELECT count(*) FROM messages WHERE channelID=?", channels[0].ID)
+	expectCount(t, db, 0, "SELECT count(*) FROM checkpoints")
+}
@@ -0,0 +1,53 @@
+package discordarchive
+
+import (
+	"errors"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// DiscordClient is the part of the Discord REST API used to archive guilds,
+// channels, messages and members. *discordgo.Session implements it, and so
+// does the in-memory fake of the discordtest package.
+//
+// A few features need more of the API. Listing the threads and forum posts
+// of a channel needs the GuildThreadsActive, ThreadsArchived and
+// ThreadsPrivateArchived methods of *discordgo.Session, and listing the direct
+// message channels of the current user needs RequestWithBucketID. Other clients
+// return ErrUnsupportedClient instead, as do clients without MessageReactions
+// when Options.SaveReactionUsers is set. The starter messages of forum posts
+// that were cut short by a limit are only archived by clients with ChannelMessage.
+type DiscordClient interface {
+	Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	Guild(guildID string, options ...discordgo.RequestOption) (*discordgo.Guild, error)
+	GuildChannels(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Channel, error)
+	ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string, options ...discordgo.RequestOption) ([]*discordgo.Message, error)
+	GuildMembers(guildID string, after string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error)
+}
+
+// threadClient lists the threads of channels.
+type threadClient interface {
+	GuildThreadsActive(guildID string, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error)
+	ThreadsArchived(channelID string, before *time.Time, limit int, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error)
+	ThreadsPrivateArchived(channelID string, before *time.Time, limit int, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error)
+}
+
+// reactionClient lists the users who added a reaction.
+type reactionClient interface {
+	MessageReactions(channelID, messageID, emojiID string, limit int, beforeID, afterID string, options ...discordgo.RequestOption) ([]*discordgo.User, error)
+}
+
+// messageClient fetches single messages.
+type messageClient interface {
+	ChannelMessage(channelID, messageID string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+}
+
+// requestClient makes requests to endpoints that have no method of their own.
+type requestClient interface {
+	RequestWithBucketID(method, urlStr string, data interface{}, bucketID string, options ...discordgo.RequestOption) ([]byte, error)
+}
+
+// ErrUnsupportedClient is returned when archiving something that needs
+// more of the Discord API than the DiscordClient given implements.
+var ErrUnsupportedClient = errors.New("error, discord client does not support this request")
@@ -2,27 +2,51 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Necroforger/discordarchive"
 
 	"github.com/bwmarrin/discordgo"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 // Flags
 var (
 	DestPath = flag.String("o", "./", "set the destination path of the generated content")
-	DBPath   = flag.String("i", "./archive.db", "set the database path")
+	DBPath   = flag.String("i", "./archive.db", "set the database path, or a database prefixed by its driver such as postgres://user@localhost/archive")
+	Media    = flag.String("media", "", "set the folder holding downloaded media, defaults to the folder of the database")
+	Storage  = flag.String("storage", "", "set the storage holding downloaded media: a folder, tar:<bundle path> or s3://<bucket>/<prefix>?endpoint=<url>. overrides -media")
 )
 
+// storage holds the downloaded media.
+var storage discordarchive.Storage
+
+// absDest is the absolute path of the destination folder.
+var absDest string
+
+// customEmojiRegex matches custom emojis in message content.
+var customEmojiRegex = regexp.MustCompile(`<(a?):(\w+):(\d+)>`)
+
+// messagesPerPage is the number of messages shown on each page of a channel.
+const messagesPerPage = 90
+
+// directMessagesID is the ID of the pseudo-guild holding direct message channels.
+const directMessagesID = "@me"
+
 // Content is the template content.
 type Content struct {
 	Page    int
@@ -35,6 +59,9 @@ type Content struct {
 	Messages []*discordgo.Message
 	Guilds   []*discordgo.Guild
 	Channels []*discordgo.Channel
+
+	// Posts of the current channel when it is a forum.
+	Posts []*discordgo.Channel
 }
 
 func main() {
@@ -44,7 +71,25 @@ func main() {
 		*DBPath = args[0]
 	}
 
-	db, err := sql.Open("sqlite3", *DBPath)
+	db, dialect, err := discordarchive.OpenDSN(*DBPath)
+	handle(err)
+
+	if *Storage == "" {
+		if *Media == "" {
+			if dialect != discordarchive.SQLite {
+				handle(errors.New("please set the folder holding downloaded media with -media or -storage"))
+			}
+			*Media = filepath.Dir(*DBPath)
+		}
+		*Storage = *Media
+	}
+	storage, err = discordarchive.OpenStorage(*Storage)
+	handle(err)
+	if c, ok := storage.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	absDest, err = filepath.Abs(*DestPath)
 	handle(err)
 
 	tmpl, err := createTemplate(db)
@@ -60,10 +105,165 @@ func handle(err error) {
 	}
 }
 
+// mediaURL returns the url of a downloaded file from a generated page,
+// as resolved by the storage holding it.
+// pathA is the path of the file in the storage.
+func mediaURL(pathA string) string {
+	if pathA == "" {
+		return ""
+	}
+
+	u := storage.URL(filepath.ToSlash(pathA))
+	if u == "" {
+		var err error
+		u, err = extractMedia(pathA)
+		if err != nil {
+			log.Println(err)
+			return ""
+		}
+	}
+	if strings.Contains(u, "://") {
+		return u
+	}
+
+	// Pages are generated two folders deep, in dest/guildID/channelID.
+	absPath, err := filepath.Abs(u)
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(absDest, absPath)
+	if err != nil {
+		return ""
+	}
+	return path.Join("../..", filepath.ToSlash(rel))
+}
+
+// extractMedia copies a file that can not be linked to, such as a file in
+// a tar bundle, into the media folder of the destination, and returns its path.
+func extractMedia(pathA string) (string, error) {
+	dst := filepath.Join(absDest, "media", pathA)
+	if _, err := os.Stat(dst); err == nil {
+		return dst, nil
+	}
+
+	r, err := storage.Open(filepath.ToSlash(pathA))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return dst, err
+}
+
+// fileResolver maps the attachments and embeds of messages to their downloaded files.
+type fileResolver struct {
+	db *sql.DB
+}
+
+// files returns the local URLs of a message's downloaded files by kind and index.
+func (r *fileResolver) files(msg *discordgo.Message) map[string]map[int]string {
+	files, err := discordarchive.MessageFiles(r.db, msg.ChannelID, msg.ID)
+	if err != nil || len(files) == 0 {
+		return nil
+	}
+
+	urls := map[string]map[int]string{}
+	for _, f := range files {
+		if urls[f.Kind] == nil {
+			urls[f.Kind] = map[int]string{}
+		}
+		urls[f.Kind][f.Index] = mediaURL(f.Path)
+	}
+	return urls
+}
+
+// attachments returns copies of a message's attachments that link to
+// their downloaded files when they have been saved.
+func (r *fileResolver) attachments(msg *discordgo.Message) []*discordgo.MessageAttachment {
+	urls := r.files(msg)[discordarchive.FileAttachment]
+	if urls == nil {
+		return msg.Attachments
+	}
+
+	attachments := make([]*discordgo.MessageAttachment, len(msg.Attachments))
+	for i, v := range msg.Attachments {
+		att := *v
+		if u, ok := urls[i]; ok {
+			att.URL = u
+		}
+		attachments[i] = &att
+	}
+	return attachments
+}
+
+// embeds returns copies of a message's embeds whose images and thumbnails
+// link to their downloaded files when they have been saved.
+func (r *fileResolver) embeds(msg *discordgo.Message) []*discordgo.MessageEmbed {
+	files := r.files(msg)
+	if files == nil {
+		return msg.Embeds
+	}
+
+	embeds := make([]*discordgo.MessageEmbed, len(msg.Embeds))
+	for i, v := range msg.Embeds {
+		embed := *v
+		if u, ok := files[discordarchive.FileEmbedImage][i]; ok && v.Image != nil {
+			img := *v.Image
+			img.URL = u
+			embed.Image = &img
+		}
+		if u, ok := files[discordarchive.FileEmbedThumbnail][i]; ok && v.Thumbnail != nil {
+			thumb := *v.Thumbnail
+			thumb.URL = u
+			embed.Thumbnail = &thumb
+		}
+		embeds[i] = &embed
+	}
+	return embeds
+}
+
+// renderContent renders a message's content, replacing custom emojis
+// with their downloaded images.
+func renderContent(db *sql.DB, content string) template.HTML {
+	var (
+		out  strings.Builder
+		last int
+	)
+	for _, m := range customEmojiRegex.FindAllStringSubmatchIndex(content, -1) {
+		out.WriteString(template.HTMLEscapeString(content[last:m[0]]))
+		last = m[1]
+
+		name, id := content[m[4]:m[5]], content[m[6]:m[7]]
+		p, err := discordarchive.EmojiPath(db, id)
+		if err != nil || p == "" {
+			out.WriteString(template.HTMLEscapeString(content[m[0]:m[1]]))
+			continue
+		}
+		fmt.Fprintf(&out, "<img class='emoji' src='%s' alt=':%s:' title=':%s:'>",
+			template.HTMLEscapeString(mediaURL(p)), template.HTMLEscapeString(name), template.HTMLEscapeString(name))
+	}
+	out.WriteString(template.HTMLEscapeString(content[last:]))
+	return template.HTML(out.String())
+}
+
 func generateAll(db *sql.DB, tmpl *template.Template, path string) error {
-	os.MkdirAll(path, 0600)
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return err
+	}
 
-	guilds, err := discordarchive.Guilds(db)
+	guilds, err := getGuilds(db)
 	if err != nil {
 		return err
 	}
@@ -79,9 +279,12 @@ func generateAll(db *sql.DB, tmpl *template.Template, path string) error {
 }
 
 func generateGuild(db *sql.DB, tmpl *template.Template, guildID, path string) error {
-	os.MkdirAll(path, 0600)
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return err
+	}
 
-	channels, err := discordarchive.Channels(db, guildID)
+	channels, err := getChannels(db, guildID)
 	if err != nil {
 		return err
 	}
@@ -96,26 +299,30 @@ func generateGuild(db *sql.DB, tmpl *template.Template, guildID, path string) er
 }
 
 func generateChannel(db *sql.DB, tmpl *template.Template, channelID, path string) error {
-	os.MkdirAll(path, 0600)
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return err
+	}
 
 	cnt := &Content{}
 
-	channel, err := discordarchive.Channel(db, channelID)
+	channel, err := getChannel(db, channelID)
 	if err != nil {
 		return err
 	}
 
-	channels, err := discordarchive.Channels(db, channel.GuildID)
+	channels, err := getChannels(db, channel.GuildID)
 	if err != nil {
 		return err
 	}
+	channels = sortChannels(channels)
 
-	guild, err := discordarchive.Guild(db, channel.GuildID)
+	guild, err := getGuild(db, channel.GuildID)
 	if err != nil {
 		return err
 	}
 
-	guilds, err := discordarchive.Guilds(db)
+	guilds, err := getGuilds(db)
 	if err != nil {
 		return err
 	}
@@ -125,7 +332,7 @@ func generateChannel(db *sql.DB, tmpl *template.Template, channelID, path string
 		return err
 	}
 
-	increment := 90
+	increment := messagesPerPage
 
 	cnt.Channels = channels
 	cnt.Guilds = guilds
@@ -133,6 +340,10 @@ func generateChannel(db *sql.DB, tmpl *template.Template, channelID, path string
 	cnt.Channel = channel
 	cnt.MaxPage = mCount / increment
 
+	if isForum(channel) {
+		return generateForum(db, tmpl, cnt, path)
+	}
+
 	for i := mCount; i > 0; i -= increment {
 		limit := increment
 		offset := i - increment
@@ -169,7 +380,212 @@ func generateChannel(db *sql.DB, tmpl *template.Template, channelID, path string
 	return nil
 }
 
+// getGuilds returns the archived guilds, followed by a
+// "Direct Messages" pseudo-guild if any direct messages were archived.
+func getGuilds(db *sql.DB) ([]*discordgo.Guild, error) {
+	guilds, err := discordarchive.Guilds(db)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := discordarchive.Count(db, "SELECT count(*) FROM channels WHERE guildID=''")
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		guilds = append(guilds, directMessagesGuild())
+	}
+
+	return guilds, nil
+}
+
+func directMessagesGuild() *discordgo.Guild {
+	return &discordgo.Guild{ID: directMessagesID, Name: "Direct Messages"}
+}
+
+// getGuild returns a guild, or the direct messages pseudo-guild
+// for channels that do not belong to a guild.
+func getGuild(db *sql.DB, guildID string) (*discordgo.Guild, error) {
+	if guildID == "" || guildID == directMessagesID {
+		return directMessagesGuild(), nil
+	}
+	return discordarchive.Guild(db, guildID)
+}
+
+// guildDir returns the name of the folder holding a guild's pages.
+func guildDir(guildID string) string {
+	if guildID == "" {
+		return directMessagesID
+	}
+	return guildID
+}
+
+// getChannels returns the channels of a guild or of the direct messages pseudo-guild.
+func getChannels(db *sql.DB, guildID string) ([]*discordgo.Channel, error) {
+	if guildID != "" && guildID != directMessagesID {
+		return discordarchive.Channels(db, guildID)
+	}
+
+	channels, err := discordarchive.DirectMessageChannels(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range channels {
+		nameDirectMessages(db, c)
+	}
+	return channels, nil
+}
+
+// getChannel returns a channel, naming it after its recipients if it is a direct message channel.
+func getChannel(db *sql.DB, channelID string) (*discordgo.Channel, error) {
+	channel, err := discordarchive.Channel(db, channelID)
+	if err != nil {
+		return nil, err
+	}
+	nameDirectMessages(db, channel)
+	return channel, nil
+}
+
+// nameDirectMessages names unnamed direct message channels after their recipients.
+func nameDirectMessages(db *sql.DB, channel *discordgo.Channel) {
+	if channel.GuildID != "" || channel.Name != "" {
+		return
+	}
+
+	recipients, err := discordarchive.Recipients(db, channel.ID)
+	if err != nil || len(recipients) == 0 {
+		channel.Name = channel.ID
+		return
+	}
+
+	names := make([]string, len(recipients))
+	for i, r := range recipients {
+		names[i] = r.Username
+	}
+	channel.Name = strings.Join(names, ", ")
+}
+
+// generateForum generates the page listing the posts of a forum channel.
+func generateForum(db *sql.DB, tmpl *template.Template, cnt *Content, path string) error {
+	posts, err := discordarchive.ForumPosts(db, cnt.Channel.ID)
+	if err != nil {
+		return err
+	}
+	// Newest posts first
+	sort.Slice(posts, func(i, j int) bool {
+		return len(posts[i].ID) > len(posts[j].ID) ||
+			len(posts[i].ID) == len(posts[j].ID) && posts[i].ID > posts[j].ID
+	})
+
+	cnt.Posts = posts
+	cnt.Page = 0
+	cnt.MaxPage = 0
+
+	f, err := os.OpenFile(
+		filepath.Join(path, cnt.Channel.Name+"-0.html"),
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600,
+	)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return tmpl.ExecuteTemplate(f, "main", cnt)
+}
+
+func isForum(channel *discordgo.Channel) bool {
+	return channel.Type == discordgo.ChannelTypeGuildForum ||
+		channel.Type == discordgo.ChannelTypeGuildMedia
+}
+
+// sortChannels orders channels by position and places
+// threads directly after their parent channels.
+func sortChannels(channels []*discordgo.Channel) []*discordgo.Channel {
+	threads := map[string][]*discordgo.Channel{}
+	parents := []*discordgo.Channel{}
+	for _, c := range channels {
+		if c.IsThread() {
+			threads[c.ParentID] = append(threads[c.ParentID], c)
+		} else {
+			parents = append(parents, c)
+		}
+	}
+	sort.SliceStable(parents, func(i, j int) bool {
+		return parents[i].Position < parents[j].Position
+	})
+
+	sorted := make([]*discordgo.Channel, 0, len(channels))
+	for _, c := range parents {
+		sorted = append(sorted, c)
+		sorted = append(sorted, threads[c.ID]...)
+		delete(threads, c.ID)
+	}
+	// Threads whose parent channel was not archived
+	for _, c := range channels {
+		if c.IsThread() && threads[c.ParentID] != nil {
+			sorted = append(sorted, c)
+		}
+	}
+	return sorted
+}
+
+// messageURL returns the url of the page holding a message,
+// relative to the page of another channel.
+func messageURL(db *sql.DB, channelID, messageID string) (string, error) {
+	channel, err := getChannel(db, channelID)
+	if err != nil {
+		return "", err
+	}
+
+	mCount, err := discordarchive.Count(db, "SELECT count(*) FROM messages WHERE channelID=?", channelID)
+	if err != nil {
+		return "", err
+	}
+	index, err := discordarchive.Count(db, "SELECT count(*) FROM messages WHERE channelID=? AND messageID<?", channelID, messageID)
+	if err != nil {
+		return "", err
+	}
+
+	// Pages are generated backwards from the newest message.
+	page := (mCount - messagesPerPage*((mCount-1-index)/messagesPerPage)) / messagesPerPage
+
+	return fmt.Sprintf("../../%s/%s/%s-%d.html#%s", guildDir(channel.GuildID), channel.ID, channel.Name, page, messageID), nil
+}
+
+// roleColor returns the color of a member's highest hoisted role
+// as a css color, or an empty string if the member has no colored hoisted role.
+func roleColor(roles []*discordgo.Role, memberRoles []string) string {
+	has := map[string]bool{}
+	for _, id := range memberRoles {
+		has[id] = true
+	}
+
+	// Roles are sorted with the highest position first.
+	for _, r := range roles {
+		if has[r.ID] && r.Hoist && r.Color != 0 {
+			return fmt.Sprintf("#%06x", r.Color)
+		}
+	}
+	return ""
+}
+
 func createTemplate(db *sql.DB) (*template.Template, error) {
+	// Roles of each guild, loaded when first needed.
+	guildRoles := map[string][]*discordgo.Role{}
+
+	// Downloaded images of each guild, loaded when first needed.
+	guildFiles := map[string]map[string]string{}
+	guildFile := func(guildID, kind string) string {
+		files, ok := guildFiles[guildID]
+		if !ok {
+			files, _ = discordarchive.GuildFiles(db, guildID)
+			guildFiles[guildID] = files
+		}
+		return files[kind]
+	}
+
+	files := &fileResolver{db: db}
+
 	tmpl := template.New("").Funcs(template.FuncMap{
 		"getavatar": func(usr *discordgo.User) string {
 			return usr.AvatarURL("32")
@@ -183,14 +599,116 @@ func createTemplate(db *sql.DB) (*template.Template, error) {
 			}
 			return nick
 		},
+		"getreactions": func(msg *discordgo.Message) []*discordgo.MessageReactions {
+			reactions, err := discordarchive.MessageReactions(db, msg.ChannelID, msg.ID)
+			if err != nil {
+				return nil
+			}
+			return reactions
+		},
+		"getattachments": files.attachments,
+		"getembeds":      files.embeds,
+		"getrevisions": func(msg *discordgo.Message) []*discordarchive.MessageRevision {
+			revisions, err := discordarchive.MessageRevisions(db, msg.ChannelID, msg.ID)
+			if err != nil {
+				return nil
+			}
+			return revisions
+		},
+		"getDeletedAt": func(msg *discordgo.Message) time.Time {
+			t, err := discordarchive.MessageDeletedAt(db, msg.ChannelID, msg.ID)
+			if err != nil {
+				return time.Time{}
+			}
+			return t
+		},
+		"getreply": func(msg *discordgo.Message) *discordgo.Message {
+			ref := msg.MessageReference
+			if ref == nil || ref.Type != discordgo.MessageReferenceTypeDefault {
+				return nil
+			}
+			channelID := ref.ChannelID
+			if channelID == "" {
+				channelID = msg.ChannelID
+			}
+			reply, err := discordarchive.Message(db, channelID, ref.MessageID)
+			if err != nil {
+				return nil
+			}
+			return reply
+		},
+		"getMessageURL": func(msg *discordgo.Message) string {
+			u, err := messageURL(db, msg.ChannelID, msg.ID)
+			if err != nil {
+				return ""
+			}
+			return u
+		},
+		"truncate": func(str string, n int) string {
+			r := []rune(str)
+			if len(r) <= n {
+				return str
+			}
+			return string(r[:n]) + "..."
+		},
+		"isForum": isForum,
+		"getStarterMessage": func(post *discordgo.Channel) *discordgo.Message {
+			msg, err := discordarchive.Message(db, post.ID, post.ID)
+			if err != nil {
+				return nil
+			}
+			return msg
+		},
+		"getPostTags": func(post *discordgo.Channel) []discordgo.ForumTag {
+			tags, err := discordarchive.ForumTags(db, post.ID)
+			if err != nil {
+				return nil
+			}
+			return tags
+		},
+		"getusercolor": func(guildID, userID string) template.CSS {
+			roles, ok := guildRoles[guildID]
+			if !ok {
+				roles, _ = discordarchive.Roles(db, guildID)
+				guildRoles[guildID] = roles
+			}
+			memberRoles, err := discordarchive.MemberRoles(db, guildID, userID)
+			if err != nil {
+				return ""
+			}
+			return template.CSS(roleColor(roles, memberRoles))
+		},
+		"rendercontent": func(msg *discordgo.Message) template.HTML {
+			return renderContent(db, msg.ContentWithMentionsReplaced())
+		},
+		"getstickers": func(msg *discordgo.Message) []*discordgo.StickerItem {
+			stickers, err := discordarchive.MessageStickers(db, msg.ChannelID, msg.ID)
+			if err != nil {
+				return nil
+			}
+			return stickers
+		},
+		"getStickerURL": func(st *discordgo.StickerItem) string {
+			p, err := discordarchive.StickerPath(db, st.ID)
+			if err != nil || p == "" {
+				return ""
+			}
+			return mediaURL(p)
+		},
+		"getGuildIcon": func(guild *discordgo.Guild) string {
+			return mediaURL(guildFile(guild.ID, discordarchive.GuildFileIcon))
+		},
+		"getGuildBanner": func(guild *discordgo.Guild) string {
+			return mediaURL(guildFile(guild.ID, discordarchive.GuildFileBanner))
+		},
 		"getGuildSplash": func(guild *discordgo.Guild) string {
-			return ""
+			return mediaURL(guildFile(guild.ID, discordarchive.GuildFileSplash))
 		},
 		"getChannelURL": func(channel *discordgo.Channel) string {
 			return "../" + channel.ID + "/" + channel.Name + "-0.html"
 		},
 		"getGuildURL": func(guild *discordgo.Guild) string {
-			channels, err := discordarchive.Channels(db, guild.ID)
+			channels, err := getChannels(db, guild.ID)
 			if err != nil {
 				return ""
 			}
@@ -202,6 +720,12 @@ func createTemplate(db *sql.DB) (*template.Template, error) {
 		"getNextPage": func(cnt *Content, offset int) string {
 			return cnt.Channel.Name + "-" + strconv.Itoa(cnt.Page+offset) + ".html"
 		},
+		"formatTime": func(t time.Time) string {
+			if t.IsZero() {
+				return ""
+			}
+			return t.Local().Format("2006-01-02 15:04")
+		},
 		"concat": func(dat ...interface{}) string {
 			return fmt.Sprint(dat...)
 		},
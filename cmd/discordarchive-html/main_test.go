@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Necroforger/discordarchive"
+	"github.com/Necroforger/discordarchive/discordtest"
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestGenerate archives a fake guild offline and renders it.
+func TestGenerate(t *testing.T) {
+	f := discordtest.NewFake()
+	f.AddGuild(&discordgo.Guild{ID: "81384788765712384", Name: "guild"})
+	channel := &discordgo.Channel{ID: "81384788765712385", GuildID: "81384788765712384", Name: "general", Type: discordgo.ChannelTypeGuildText}
+	f.AddChannel(channel)
+	author := &discordgo.User{ID: "80351110224678912", Username: "author"}
+	f.AddMessages(discordtest.Messages(channel, author, 0, 100)...)
+
+	srv := discordtest.NewServer(f)
+	defer srv.Close()
+	srv.RateLimitEvery = 5
+
+	dir := t.TempDir()
+	db, dialect, err := discordarchive.OpenDSN(filepath.Join(dir, "archive.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	a := discordarchive.New()
+	a.Dialect = dialect
+	sink, err := discordarchive.NewDBSink(a, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.ArchiveGuildTo(srv.Session(), sink, "81384788765712384", nil)
+	a.Wait()
+	if cerr := sink.Close(); err == nil {
+		err = cerr
+	}
+	a.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = discordarchive.OpenStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	absDest = filepath.Join(dir, "html")
+
+	tmpl, err := createTemplate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = generateAll(db, tmpl, absDest); err != nil {
+		t.Fatal(err)
+	}
+
+	// 100 messages fill two pages of messagesPerPage.
+	channelDir := filepath.Join(absDest, channel.GuildID, channel.ID)
+	for page, want := range map[string]string{"general-1.html": "message 99", "general-0.html": "message 0"} {
+		b, err := os.ReadFile(filepath.Join(channelDir, page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), want) {
+			t.Fatalf("%s does not contain %q", page, want)
+		}
+	}
+}
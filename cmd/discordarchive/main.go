@@ -1,128 +1,578 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Necroforger/discordarchive"
 	"github.com/bwmarrin/discordgo"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 // Flags
 var (
 	OutPath         = flag.String("o", "./", "output folder")
+	DB              = flag.String("db", "", "database to archive to, prefixed by its driver, such as postgres://user@localhost/archive or sqlite3:archive.db. defaults to archive.db in the output folder")
+	NDJSONPath      = flag.String("ndjson", "", "write the archive as newline-delimited JSON files, one per channel, to this folder instead of the database")
+	StoragePath     = flag.String("storage", "", "where to store downloaded files: a folder, tar:<bundle path> or s3://<bucket>/<prefix>?endpoint=<url>. defaults to the output folder")
 	SaveEmbeds      = flag.Bool("embeds", false, "save images in embeds to files")
 	SaveAttachments = flag.Bool("attachments", false, "save message attachments to files")
 	SaveAvatars     = flag.Bool("avatars", false, "Save user avatars to files")
+	BlobStorage     = flag.Bool("blobs", false, "store attachments and embed images once per content under blobs/, named by their sha256 hash")
+	SaveGuildImages = flag.Bool("guild-images", false, "save guild icons, banners and splashes to files")
+	SaveEmojis      = flag.Bool("emojis", false, "save custom emoji and sticker images to files")
+	ReactionUsers   = flag.Bool("reaction-users", false, "save the users who added each reaction")
+	ChannelTypes    = flag.String("channel-types", "", "comma separated list of channel types to archive with -g: text, news, voice, stage, forum, media")
+	IncludeThreads  = flag.Bool("threads", false, "archive the threads of each channel")
+	Concurrency     = flag.Int("concurrency", 1, "number of channels to archive at once with -g")
 	AvatarSize      = flag.String("avatar-size", "", "Size of avatars when saving to file as a power of 2")
 	ArchiveMembers  = flag.Bool("members", false, "Archive the members of a guild when archiving channels")
 	Skip            = flag.Int("skip", 0, "number of messages to skip before archiving")
 	Limit           = flag.Int("limit", 0, "maximum number of messages to archive")
+	Update          = flag.Bool("update", false, "only archive messages newer than the newest archived message")
+	Backfill        = flag.Bool("backfill", false, "with -update, continue archiving older messages that have not been archived yet")
+	CommitEvery     = flag.Int("commit-every", 1000, "commit to the database every n messages, as well as after every channel. 0 commits after every channel only")
+	Reconcile       = flag.Bool("reconcile", false, "mark archived messages that no longer exist as deleted and record edits before archiving")
 	MethodGuild     = flag.Bool("g", false, "Save a guild or list of guilds")
+	MethodDM        = flag.Bool("dm", false, "Save direct message channels, or every direct message channel if no ids are given")
+	Watch           = flag.Bool("watch", false, "after archiving, keep recording new, edited and deleted messages until interrupted. watches every channel with -g or -dm")
+	Retries         = flag.Int("retries", 3, "number of times to retry a download after a server error, rate limit or timeout")
+	RetryBackoff    = flag.Duration("retry-backoff", time.Second, "delay before the first download retry, doubled on every retry")
 	Token           = flag.String("t", "", "Discord token")
 )
 
+// exitCode is the status the program exits with once archiving stops.
+var exitCode int
+
+// fail logs err and makes the program exit with a non-zero status.
+func fail(err error) {
+	log.Println(err)
+	exitCode = 1
+}
+
+// reportChannelErrors logs the channels or threads of target that could not
+// be archived, and reports whether err was a ChannelErrors.
+func reportChannelErrors(err error, target string) bool {
+	errs, ok := err.(discordarchive.ChannelErrors)
+	if !ok {
+		return false
+	}
+	log.Printf("failed to archive %d channels or threads in %s:", len(errs), target)
+	for _, e := range errs {
+		log.Printf("  %s (%s): %s", e.ChannelName, e.ChannelID, e.Err)
+	}
+	exitCode = 1
+	return true
+}
+
 func main() {
 	flag.Parse()
+	// Deferred first so that it runs after everything else is closed.
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
 
 	args := flag.Args()
-	if len(args) == 0 {
+	if len(args) == 0 && !*MethodDM && !*Watch {
 		log.Println("Please enter a target id")
 	}
 
+	if *Update && *Skip > 0 {
+		fail(errors.New("-update can not be used with -skip"))
+		return
+	}
+
+	if len(args) > 0 && args[0] == "migrate" {
+		migrate(args[1:])
+		return
+	}
+
+	// Interrupting the program stops archiving and keeps what was archived.
+	// Interrupting it a second time exits immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if len(args) > 0 && args[0] == "download" {
+		download(ctx, args[1:])
+		return
+	}
+
 	session, err := discordgo.New(*Token)
 	if err != nil {
-		log.Println(err)
+		fail(err)
 		return
 	}
 	err = session.Open()
 	if err != nil {
-		log.Println(err)
+		fail(err)
+		return
+	}
+
+	err = os.MkdirAll(*OutPath, 0755)
+	if err != nil {
+		fail(err)
 		return
 	}
 
-	os.MkdirAll(*OutPath, 0600)
+	// Archiving to -ndjson files only does not use the database.
+	var db *sql.DB
+	var dialect discordarchive.Dialect
+	if *NDJSONPath == "" || *Watch || (len(args) > 0 && args[0] == "reconcile") {
+		db, dialect, err = openDB()
+		if err != nil {
+			fail(err)
+			return
+		}
+		defer db.Close()
+	}
 
-	db, err := sql.Open("sqlite3", filepath.Join(*OutPath, "archive.db"))
+	arc, err := newArchiver(dialect)
 	if err != nil {
-		log.Println(err)
+		fail(err)
 		return
 	}
-	defer db.Close()
+	defer arc.Close()
 
-	tx, err := db.Begin()
+	if len(args) > 0 && args[0] == "reconcile" {
+		reconcile(ctx, session, db, arc, args[1:])
+		return
+	}
+
+	if len(args) > 0 || *MethodDM {
+		archive(ctx, session, db, arc, args)
+		if ctx.Err() != nil {
+			printResume()
+			return
+		}
+	}
+
+	if *Watch {
+		watch(ctx, session, db, arc, args)
+	}
+}
+
+// printResume explains how to resume archiving after the program was interrupted.
+func printResume() {
+	if *NDJSONPath != "" {
+		log.Println("interrupted: the messages archived so far were written to", *NDJSONPath)
+		log.Println("-ndjson archives can not be resumed, running the command again archives every message again")
+		return
+	}
+	log.Println("interrupted: the messages archived so far were saved")
+	log.Println("to resume, run the same command again. channels continue from where they stopped")
+}
+
+// archive archives the targets given on the command line to the database, committing
+// every -commit-every messages and after every channel, or to newline-delimited JSON
+// files with -ndjson. If ctx is done, archiving stops and what was archived until then is kept.
+func archive(ctx context.Context, session *discordgo.Session, db *sql.DB, arc *discordarchive.Archiver, args []string) {
+	if *NDJSONPath != "" {
+		sink, err := discordarchive.NewJSONSink(*NDJSONPath)
+		if err != nil {
+			fail(err)
+			return
+		}
+		defer func() {
+			// Downloads write their files to the sink, so they must finish first.
+			arc.Wait()
+			sink.Close()
+		}()
+
+		archiveTo(ctx, session, arc, sink, args)
+		return
+	}
+
+	sink, err := discordarchive.NewDBSink(arc, db, *CommitEvery)
 	if err != nil {
-		log.Println(err)
+		fail(err)
 		return
 	}
 
 	defer func() {
-		err = tx.Commit()
+		// The last transaction is committed once the downloads recorded in it finish.
+		err = sink.Close()
 		if err != nil {
-			log.Println(err)
-			return
+			fail(err)
 		}
 	}()
 
-	arc := discordarchive.New()
-	arc.Log = os.Stderr
-	arc.SavePath = *OutPath
+	archiveTo(ctx, session, arc, sink, args)
+}
+
+// archiveTo archives the targets given on the command line to a sink until ctx is done.
+func archiveTo(ctx context.Context, session *discordgo.Session, arc *discordarchive.Archiver, sink discordarchive.Sink, args []string) {
+	var err error
 
 	switch {
+	// Archive direct messages
+	case *MethodDM:
+		err = arc.ArchiveDirectMessagesToContext(ctx, session, sink, messageOptions(), args...)
+		if !reportChannelErrors(err, "direct messages") && err != nil {
+			fail(err)
+			return
+		}
 	// Archive guilds
 	case *MethodGuild:
 		for _, id := range args {
-			err = arc.ArchiveGuild(session, tx, id, &discordarchive.Options{
-				SaveAttachments: *SaveAttachments,
-				SaveAvatars:     *SaveAvatars,
-				SaveEmbedImages: *SaveEmbeds,
-				Skip:            *Skip,
-				Limit:           *Limit,
-			})
-			if err != nil {
-				log.Println(err)
+			err = arc.ArchiveGuildToContext(ctx, session, sink, id, messageOptions())
+			if !reportChannelErrors(err, "guild "+id) && err != nil {
+				fail(err)
 				return
 			}
-			err = arc.ArchiveMembers(session, tx, id, &discordarchive.Options{
+			err = arc.ArchiveMembersToContext(ctx, session, sink, id, &discordarchive.Options{
 				SaveAvatars: *SaveAvatars,
 				AvatarSize:  *AvatarSize,
 			})
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("failed to archive the members of guild %s: %s", id, err)
+				exitCode = 1
+			}
 		}
 		// Archive channels
 	default:
 		for _, id := range args {
-			err = arc.ArchiveChannel(session, tx, id, &discordarchive.Options{
-				SaveAttachments: *SaveAttachments,
-				SaveAvatars:     *SaveAvatars,
-				SaveEmbedImages: *SaveEmbeds,
-				Skip:            *Skip,
-				Limit:           *Limit,
-			})
+			err = arc.ArchiveChannelToContext(ctx, session, sink, id, messageOptions())
 			if err != nil {
-				log.Println(err)
+				fail(err)
 				return
 			}
 
 			if *ArchiveMembers {
 				channel, err := session.Channel(id)
 				if err != nil {
-					log.Println(err)
+					fail(err)
 					return
 				}
 
-				err = arc.ArchiveMembers(session, tx, channel.GuildID, &discordarchive.Options{
+				err = arc.ArchiveMembersToContext(ctx, session, sink, channel.GuildID, &discordarchive.Options{
 					SaveAvatars: *SaveAvatars,
 					AvatarSize:  *AvatarSize,
 				})
 				if err != nil {
-					log.Println(err)
+					fail(err)
 					return
 				}
 			}
 		}
 	}
 }
+
+// watch records messages from the gateway until the program is interrupted.
+func watch(ctx context.Context, session *discordgo.Session, db *sql.DB, arc *discordarchive.Archiver, args []string) {
+	var channelIDs []string
+	if !*MethodGuild && !*MethodDM {
+		channelIDs = args
+	}
+
+	stop, err := arc.Watch(session, db, messageOptions(), channelIDs...)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer stop()
+
+	log.Println("watching for messages, press ctrl-c to stop")
+	<-ctx.Done()
+}
+
+// messageOptions returns the options used to archive channel messages.
+func messageOptions() *discordarchive.Options {
+	return &discordarchive.Options{
+		SaveAttachments:    *SaveAttachments,
+		SaveAvatars:        *SaveAvatars,
+		SaveEmbedImages:    *SaveEmbeds,
+		SaveGuildImages:    *SaveGuildImages,
+		SaveEmojis:         *SaveEmojis,
+		SaveReactionUsers:  *ReactionUsers,
+		ChannelTypes:       channelTypes(),
+		IncludeThreads:     *IncludeThreads,
+		Skip:               *Skip,
+		Limit:              *Limit,
+		Update:             *Update,
+		Backfill:           *Backfill,
+		Reconcile:          *Reconcile,
+		ChannelConcurrency: *Concurrency,
+		BlobStorage:        *BlobStorage,
+	}
+}
+
+// channelTypeNames maps the names accepted by -channel-types to channel types.
+var channelTypeNames = map[string]discordgo.ChannelType{
+	"text":  discordgo.ChannelTypeGuildText,
+	"news":  discordgo.ChannelTypeGuildNews,
+	"voice": discordgo.ChannelTypeGuildVoice,
+	"stage": discordgo.ChannelTypeGuildStageVoice,
+	"forum": discordgo.ChannelTypeGuildForum,
+	"media": discordgo.ChannelTypeGuildMedia,
+}
+
+// channelTypes parses the -channel-types flag.
+// Returns nil to use the default channel types.
+func channelTypes() map[discordgo.ChannelType]bool {
+	if *ChannelTypes == "" {
+		return nil
+	}
+
+	types := map[discordgo.ChannelType]bool{}
+	for _, name := range strings.Split(*ChannelTypes, ",") {
+		t, ok := channelTypeNames[strings.TrimSpace(name)]
+		if !ok {
+			log.Println("unknown channel type:", name)
+			continue
+		}
+		types[t] = true
+	}
+	return types
+}
+
+// reconcile checks archived channels for messages that were deleted or edited
+// since they were archived, and prints a summary of the deletions in each channel.
+// Each channel is reconciled in a transaction of its own, so that a channel
+// that fails does not stop the rest from being saved.
+// usage: discordarchive -t token [-o folder] reconcile [channel ids...]
+func reconcile(ctx context.Context, session *discordgo.Session, db *sql.DB, arc *discordarchive.Archiver, channelIDs []string) {
+	if len(channelIDs) == 0 {
+		var err error
+		channelIDs, err = discordarchive.ArchivedChannelIDs(db)
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	var deleted, edited int
+	for _, id := range channelIDs {
+		result, err := reconcileChannel(ctx, session, db, arc, id)
+		if ctx.Err() != nil {
+			log.Println("interrupted: the channels reconciled so far were saved")
+			break
+		}
+		if err != nil {
+			fail(fmt.Errorf("%s: %s", id, err))
+			continue
+		}
+		deleted += result.Deleted
+		edited += result.Edited
+		fmt.Printf("%s (%s): %d deleted, %d edited of %d archived messages\n",
+			result.ChannelName, result.ChannelID, result.Deleted, result.Edited, result.Checked)
+	}
+	fmt.Printf("total: %d deleted, %d edited in %d channels\n", deleted, edited, len(channelIDs))
+}
+
+// reconcileChannel reconciles a channel in a transaction of its own.
+func reconcileChannel(ctx context.Context, session *discordgo.Session, db *sql.DB, arc *discordarchive.Archiver, channelID string) (*discordarchive.ReconcileResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := arc.ReconcileChannelContext(ctx, session, tx, channelID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return result, tx.Commit()
+}
+
+// openDB opens the database given with -db, or archive.db in the output folder.
+func openDB() (*sql.DB, discordarchive.Dialect, error) {
+	dsn := *DB
+	if dsn == "" {
+		dsn = filepath.Join(*OutPath, "archive.db")
+	}
+	return discordarchive.OpenDSN(dsn)
+}
+
+// newArchiver returns an archiver for a database of the given dialect that saves
+// files to the output folder, or to the storage given with -storage.
+func newArchiver(dialect discordarchive.Dialect) (*discordarchive.Archiver, error) {
+	arc := discordarchive.New()
+	arc.Log = os.Stderr
+	arc.Dialect = dialect
+	arc.SavePath = *OutPath
+	arc.DownloadRetries = *Retries
+	arc.DownloadBackoff = *RetryBackoff
+
+	if *StoragePath != "" {
+		storage, err := discordarchive.OpenStorage(*StoragePath)
+		if err != nil {
+			return nil, err
+		}
+		arc.Storage = storage
+	}
+	return arc, nil
+}
+
+// download downloads the media of an existing archive without fetching any messages.
+// The kinds of media are chosen with -attachments, -embeds, -avatars and -emojis.
+// Failed downloads from earlier runs are retried instead with --retry-failed.
+// usage: discordarchive [-o folder] [media options] download [--retry-failed] [-guild ids] [-channel ids] [-mime types] [-max-size bytes]
+func download(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	retryFailed := fs.Bool("retry-failed", false, "retry every download that failed in earlier runs")
+	guilds := fs.String("guild", "", "comma separated list of guilds to download media from")
+	channels := fs.String("channel", "", "comma separated list of channels to download media from")
+	mimeTypes := fs.String("mime", "", "comma separated list of MIME types to download, such as image/png or image/")
+	maxSize := fs.Int64("max-size", 0, "largest attachment to download in bytes")
+	fs.Parse(args)
+
+	opt := messageOptions()
+	if !*retryFailed && !opt.SaveAttachments && !opt.SaveEmbedImages && !opt.SaveAvatars && !opt.SaveEmojis {
+		fail(errors.New("please choose the media to download with -attachments, -embeds, -avatars or -emojis, or use --retry-failed"))
+		return
+	}
+
+	db, dialect, err := openDB()
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer db.Close()
+
+	arc, err := newArchiver(dialect)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer arc.Close()
+
+	if *retryFailed {
+		n, err := retryDownloads(ctx, db, arc, opt)
+		if err != nil {
+			fail(err)
+			return
+		}
+		fmt.Printf("retried %d downloads\n", n)
+	} else {
+		err = arc.DownloadMediaContext(ctx, db, &discordarchive.MediaFilter{
+			GuildIDs:   splitList(*guilds),
+			ChannelIDs: splitList(*channels),
+			MIMETypes:  splitList(*mimeTypes),
+			MaxSize:    *maxSize,
+		}, opt)
+		if ctx.Err() != nil {
+			log.Println("interrupted: the files downloaded so far were saved, run the same command again to download the rest")
+		} else if err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	failed, err := discordarchive.FailedDownloads(db)
+	if err != nil {
+		fail(err)
+		return
+	}
+	fmt.Printf("%d downloads failed\n", len(failed))
+}
+
+// retryDownloads retries the failed downloads of an archive in a single transaction.
+// Once ctx is done, downloads are no longer retried.
+func retryDownloads(ctx context.Context, db *sql.DB, arc *discordarchive.Archiver, opt *discordarchive.Options) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := arc.RetryFailedDownloadsContext(ctx, tx, opt)
+	if err != nil {
+		tx.Rollback()
+		return n, err
+	}
+
+	return n, tx.Commit()
+}
+
+// splitList splits a comma separated flag value.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		list = append(list, strings.TrimSpace(v))
+	}
+	return list
+}
+
+// migrate upgrades the schema of archive databases in place.
+// Databases are given as paths of SQLite databases, or names prefixed by their driver as with -db.
+// usage: discordarchive [-o folder] [-db database] migrate [databases...]
+func migrate(paths []string) {
+	if len(paths) == 0 {
+		paths = []string{*DB}
+		if *DB == "" {
+			paths = []string{filepath.Join(*OutPath, "archive.db")}
+		}
+	}
+
+	for _, path := range paths {
+		db, dialect, err := discordarchive.OpenDSN(path)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		// Do not create SQLite databases that do not exist yet.
+		if dialect == discordarchive.SQLite && !strings.Contains(path, ":") {
+			if _, err := os.Stat(path); err != nil {
+				db.Close()
+				fail(err)
+				return
+			}
+		}
+
+		arc := discordarchive.New()
+		arc.Log = os.Stderr
+		arc.Dialect = dialect
+
+		from, to, err := migrateDB(arc, db)
+		db.Close()
+		if err != nil {
+			fail(fmt.Errorf("%s: %s", path, err))
+			return
+		}
+		if from == to {
+			log.Printf("%s: schema is up to date at version %d", path, to)
+		} else {
+			log.Printf("%s: migrated schema from version %d to %d", path, from, to)
+		}
+	}
+}
+
+func migrateDB(arc *discordarchive.Archiver, db *sql.DB) (from, to int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	from, to, err = arc.Migrate(tx)
+	if err != nil {
+		tx.Rollback()
+		return from, to, err
+	}
+
+	return from, to, tx.Commit()
+}
@@ -0,0 +1,280 @@
+package discordarchive
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Dialect describes how the SQL used by the archiver differs between databases.
+// Queries are written with ? placeholders, explicit column lists and upserts
+// using ON CONFLICT, which SQLite and PostgreSQL both understand.
+type Dialect interface {
+	// Rebind rewrites the ? placeholders of a query to those used by the database.
+	Rebind(query string) string
+
+	// Types rewrites the column types of a statement creating or altering
+	// a table, as written in the migrations, to types of the database
+	// that hold the same values.
+	Types(statement string) string
+
+	// ColumnsQuery returns a query for the names of the columns of a table.
+	ColumnsQuery(table string) string
+}
+
+// Supported dialects
+var (
+	SQLite   Dialect = sqliteDialect{}
+	Postgres Dialect = postgresDialect{}
+)
+
+// DialectFor returns the dialect of a database/sql driver.
+func DialectFor(driverName string) (Dialect, error) {
+	switch driverName {
+	case "sqlite3", "sqlite":
+		return SQLite, nil
+	case "postgres", "pgx":
+		return Postgres, nil
+	}
+	return nil, errors.New("error, unsupported database driver " + driverName)
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Rebind(query string) string { return query }
+
+func (sqliteDialect) Types(statement string) string { return statement }
+
+func (sqliteDialect) ColumnsQuery(table string) string {
+	return "SELECT name FROM pragma_table_info('" + table + "')"
+}
+
+type postgresDialect struct{}
+
+// Rebind rewrites ? placeholders to $1, $2 and so on,
+// leaving quoted strings and identifiers untouched.
+func (postgresDialect) Rebind(query string) string {
+	var (
+		b     strings.Builder
+		n     int
+		quote byte
+	)
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// intType matches the INT columns of the migrations.
+var intType = regexp.MustCompile(`\bINT\b`)
+
+// Types stores INT columns as BIGINT, which holds the 64 bit
+// integers SQLite stores in them, such as message flags and file sizes.
+// INTEGER PRIMARY KEY columns, which SQLite numbers in the order rows
+// are inserted, are stored as BIGSERIAL, which PostgreSQL numbers the same way.
+func (postgresDialect) Types(statement string) string {
+	statement = strings.ReplaceAll(statement, "INTEGER PRIMARY KEY", "BIGSERIAL PRIMARY KEY")
+	return intType.ReplaceAllString(statement, "BIGINT")
+}
+
+func (postgresDialect) ColumnsQuery(table string) string {
+	return "SELECT column_name FROM information_schema.columns " +
+		"WHERE table_schema=current_schema() AND table_name='" + table + "'"
+}
+
+// upsertSQL returns a statement inserting columns into table that updates the
+// other columns of the existing row when a row with the same conflict columns
+// already exists. Both are comma separated lists.
+func upsertSQL(table, conflict, columns string) string {
+	cols := strings.Split(columns, ", ")
+	keys := map[string]bool{}
+	for _, c := range strings.Split(conflict, ", ") {
+		keys[c] = true
+	}
+
+	var updates []string
+	for _, c := range cols {
+		if !keys[c] {
+			updates = append(updates, c+"=excluded."+c)
+		}
+	}
+
+	query := "INSERT INTO " + table + "(" + columns + ") " +
+		"VALUES(" + strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", ") + ") " +
+		"ON CONFLICT(" + conflict + ") "
+	if len(updates) == 0 {
+		return query + "DO NOTHING"
+	}
+	return query + "DO UPDATE SET " + strings.Join(updates, ", ")
+}
+
+// Open opens a database for archiving with a registered database/sql driver,
+// such as sqlite3 or postgres. Queries made on the database may use ?
+// placeholders regardless of the driver, as they are rewritten by its dialect.
+func Open(driverName, dataSourceName string) (*sql.DB, error) {
+	dialect, err := DialectFor(driverName)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == SQLite {
+		return sql.Open(driverName, dataSourceName)
+	}
+
+	// Open the database once to look up the driver.
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	d := db.Driver()
+	db.Close()
+
+	var connector driver.Connector = &dsnConnector{dsn: dataSourceName, driver: d}
+	if dc, ok := d.(driver.DriverContext); ok {
+		connector, err = dc.OpenConnector(dataSourceName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sql.OpenDB(&rebindConnector{Connector: connector, dialect: dialect}), nil
+}
+
+// OpenDSN opens a database from a data source name prefixed by the name of its
+// driver, such as sqlite3:archive.db or postgres://user@localhost/archive.
+// A name without the prefix of a registered driver is the path of a SQLite database.
+// It returns the database along with its dialect.
+func OpenDSN(dsn string) (*sql.DB, Dialect, error) {
+	driverName, dataSourceName := "sqlite3", dsn
+	if i := strings.Index(dsn, ":"); i > 0 {
+		for _, d := range sql.Drivers() {
+			if d != dsn[:i] {
+				continue
+			}
+			driverName, dataSourceName = d, dsn[i+1:]
+			// URLs such as postgres://host/db are passed to the driver whole.
+			if strings.HasPrefix(dataSourceName, "//") {
+				dataSourceName = dsn
+			}
+		}
+	}
+
+	dialect, err := DialectFor(driverName)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := Open(driverName, dataSourceName)
+	return db, dialect, err
+}
+
+// dsnConnector opens connections with a driver that does not implement driver.DriverContext.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c *dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// rebindConnector opens connections that rewrite the placeholders of queries.
+type rebindConnector struct {
+	driver.Connector
+	dialect Dialect
+}
+
+func (c *rebindConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &rebindConn{Conn: conn, dialect: c.dialect}, nil
+}
+
+// rebindConn rewrites the placeholders of every query made on a connection.
+// Optional interfaces of the connection are passed through, and
+// driver.ErrSkip is returned for those it does not implement.
+//
+// Drivers such as lib/pq can not run a query on a connection while the rows
+// of another are being read, so the archiver closes the rows it reads from
+// a transaction before writing to it.
+type rebindConn struct {
+	driver.Conn
+	dialect Dialect
+}
+
+func (c *rebindConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(c.dialect.Rebind(query))
+}
+
+func (c *rebindConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, c.dialect.Rebind(query))
+	}
+	return c.Prepare(query)
+}
+
+func (c *rebindConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	if opts.ReadOnly || opts.Isolation != 0 {
+		return nil, errors.New("error, database driver does not support transaction options")
+	}
+	return c.Conn.Begin()
+}
+
+func (c *rebindConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, c.dialect.Rebind(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *rebindConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, c.dialect.Rebind(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *rebindConn) CheckNamedValue(v *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(v)
+	}
+	return driver.ErrSkip
+}
+
+func (c *rebindConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *rebindConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
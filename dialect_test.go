@@ -0,0 +1,249 @@
+package discordarchive
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Necroforger/discordarchive/discordtest"
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// testDialect migrates an empty database of a dialect, archives testGuild to
+// it and downloads the attachments of its messages with DownloadMedia, which
+// records downloads in the transaction its messages are read from.
+func testDialect(t *testing.T, db *sql.DB, dialect Dialect) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\n" + r.URL.Path))
+	}))
+	defer srv.Close()
+
+	f, channels := testGuild()
+	msgs := discordtest.Messages(channels[1], &discordgo.User{ID: "80351110224678912"}, 30, 20)
+	for _, msg := range msgs {
+		msg.Attachments = []*discordgo.MessageAttachment{{
+			ID: msg.ID, URL: srv.URL + "/" + msg.ID + ".png", Filename: msg.ID + ".png", ContentType: "image/png",
+		}}
+	}
+	f.AddMessages(msgs...)
+
+	a := New()
+	a.Dialect = dialect
+	a.SavePath = t.TempDir()
+	defer a.Close()
+
+	sink, err := NewDBSink(a, db, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.ArchiveGuildTo(f, sink, "81384788765712384", NewOptions())
+	if cerr := sink.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCount(t, db, 250, "SELECT count(*) FROM messages WHERE channelID=?", channels[0].ID)
+	expectCount(t, db, 50, "SELECT count(*) FROM messages WHERE channelID=?", channels[1].ID)
+
+	opt := NewOptions()
+	opt.SaveAttachments = true
+	for i := 0; i < 2; i++ {
+		if err = a.DownloadMedia(db, nil, opt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectCount(t, db, 20, "SELECT count(*) FROM files WHERE kind=?", FileAttachment)
+	expectCount(t, db, 20, "SELECT count(*) FROM downloads WHERE status=?", DownloadDone)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if v, err := DBSchemaVersion(tx); err != nil || v != SchemaVersion {
+		t.Fatalf("got schema version %d, want %d: %v", v, SchemaVersion, err)
+	}
+}
+
+// TestRebindConn archives through a connection of Open, using SQLite in place of
+// a database such as PostgreSQL, with a driver that fails queries made while
+// the rows of another query are open, as lib/pq does.
+func TestRebindConn(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "archive.db")
+	connector := &oneResultConnector{Connector: &dsnConnector{dsn: dsn, driver: &sqlite3.SQLiteDriver{}}}
+	db := sql.OpenDB(&rebindConnector{Connector: connector, dialect: SQLite})
+	defer db.Close()
+	testDialect(t, db, SQLite)
+}
+
+// errOpenResult is returned by a oneResultConn for queries made
+// while the rows of another query are open.
+var errOpenResult = errors.New("there is already an open result set on the connection")
+
+// oneResultConnector opens oneResultConns.
+type oneResultConnector struct {
+	driver.Connector
+}
+
+func (c *oneResultConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &oneResultConn{Conn: conn}, nil
+}
+
+// oneResultConn fails queries made while the rows of another query are open.
+// database/sql only uses a connection from one goroutine at a time, except
+// to close rows, so open is guarded by mu.
+type oneResultConn struct {
+	driver.Conn
+	mu   sync.Mutex
+	open bool
+}
+
+func (c *oneResultConn) check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open {
+		return errOpenResult
+	}
+	return nil
+}
+
+func (c *oneResultConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *oneResultConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c *oneResultConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	rows, err := c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.open = true
+	c.mu.Unlock()
+	return &oneResultRows{Rows: rows, conn: c}, nil
+}
+
+func (c *oneResultConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	stmt, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &oneResultStmt{Stmt: stmt, conn: c}, nil
+}
+
+// oneResultStmt is a statement prepared on a oneResultConn.
+type oneResultStmt struct {
+	driver.Stmt
+	conn *oneResultConn
+}
+
+func (s *oneResultStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := s.conn.check(); err != nil {
+		return nil, err
+	}
+	return s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+}
+
+func (s *oneResultStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := s.conn.check(); err != nil {
+		return nil, err
+	}
+	rows, err := s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	s.conn.mu.Lock()
+	s.conn.open = true
+	s.conn.mu.Unlock()
+	return &oneResultRows{Rows: rows, conn: s.conn}, nil
+}
+
+// oneResultRows are the open rows of a oneResultConn.
+type oneResultRows struct {
+	driver.Rows
+	conn *oneResultConn
+}
+
+func (r *oneResultRows) Close() error {
+	r.conn.mu.Lock()
+	r.conn.open = false
+	r.conn.mu.Unlock()
+	return r.Rows.Close()
+}
+
+// TestPostgres archives to the PostgreSQL database named by the environment
+// variable DISCORDARCHIVE_POSTGRES_DSN, in a schema that is dropped afterwards.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("DISCORDARCHIVE_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("DISCORDARCHIVE_POSTGRES_DSN is not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	schema := "discordarchive_test_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if _, err = admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+
+	// Unknown settings are sent to the server as run-time parameters.
+	switch {
+	case !strings.Contains(dsn, "://"):
+		dsn += " search_path=" + schema
+	case strings.Contains(dsn, "?"):
+		dsn += "&search_path=" + schema
+	default:
+		dsn += "?search_path=" + schema
+	}
+	db, err := Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testDialect(t, db, Postgres)
+}
+
+func TestPostgresTypes(t *testing.T) {
+	got := Postgres.Types("CREATE TABLE t(id INTEGER PRIMARY KEY, type INT, flags INT, idx INT NOT NULL DEFAULT 0, INTERVAL TEXT, point INTEGER)")
+	want := "CREATE TABLE t(id BIGSERIAL PRIMARY KEY, type BIGINT, flags BIGINT, idx BIGINT NOT NULL DEFAULT 0, INTERVAL TEXT, point INTEGER)"
+	if got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,88 @@
+package discordarchive
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// userChannels returns the direct message and group direct message
+// channels of the current user.
+func userChannels(ctx context.Context, s DiscordClient) ([]*discordgo.Channel, error) {
+	rc, ok := s.(requestClient)
+	if !ok {
+		return nil, ErrUnsupportedClient
+	}
+
+	endpoint := discordgo.EndpointUserChannels("@me")
+	body, err := rc.RequestWithBucketID("GET", endpoint, nil, endpoint, discordgo.WithContext(ctx))
+	if err != nil {
+		return nil, requestErr(ctx, err)
+	}
+
+	var channels []*discordgo.Channel
+	err = json.Unmarshal(body, &channels)
+	return channels, err
+}
+
+// ArchiveDirectMessages archives direct message and group direct message channels.
+// If no channel IDs are given, every private channel of the current user is archived.
+// As with ArchiveChannel, the files downloaded from the channels are recorded
+// in tx before it returns.
+func (a *Archiver) ArchiveDirectMessages(s DiscordClient, tx *sql.Tx, opt *Options, channelIDs ...string) error {
+	return a.ArchiveDirectMessagesContext(context.Background(), s, tx, opt, channelIDs...)
+}
+
+// ArchiveDirectMessagesContext archives direct message and group direct message
+// channels until ctx is done, as ArchiveChannelContext does.
+func (a *Archiver) ArchiveDirectMessagesContext(ctx context.Context, s DiscordClient, tx *sql.Tx, opt *Options, channelIDs ...string) error {
+	err := a.InitDB(tx, opt)
+	if err != nil {
+		return err
+	}
+
+	sink := a.sqlSink(tx)
+	defer sink.Close()
+	return a.ArchiveDirectMessagesToContext(ctx, s, sink, opt, channelIDs...)
+}
+
+// ArchiveDirectMessagesTo archives direct message and group direct message channels to a sink.
+// If no channel IDs are given, every private channel of the current user is archived.
+func (a *Archiver) ArchiveDirectMessagesTo(s DiscordClient, sink Sink, opt *Options, channelIDs ...string) error {
+	return a.ArchiveDirectMessagesToContext(context.Background(), s, sink, opt, channelIDs...)
+}
+
+// ArchiveDirectMessagesToContext archives direct message and group direct message
+// channels to a sink until ctx is done. Channels that fail to archive do not stop
+// the rest from being archived; their errors are returned together as ChannelErrors.
+func (a *Archiver) ArchiveDirectMessagesToContext(ctx context.Context, s DiscordClient, sink Sink, opt *Options, channelIDs ...string) error {
+	if len(channelIDs) == 0 {
+		channels, err := userChannels(ctx, s)
+		if err != nil {
+			return err
+		}
+		for _, c := range channels {
+			channelIDs = append(channelIDs, c.ID)
+		}
+	}
+
+	var errs ChannelErrors
+	for _, id := range channelIDs {
+		a.logf("[info] archiving direct messages [%s]", id)
+		err := a.ArchiveChannelToContext(ctx, s, sink, id, opt)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			a.logf("[error] error archiving direct messages [%s]: %s", id, err.Error())
+			errs = append(errs, &ChannelError{ChannelID: id, Err: err})
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
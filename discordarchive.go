@@ -1,6 +1,8 @@
 package discordarchive
 
 import (
+	"bufio"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -19,6 +21,10 @@ import (
 var (
 	ErrNoChannels = errors.New("error, no channels found in guild")
 	ErrNotUnique  = errors.New("error, value does not meet the unique constraint")
+
+	// ErrUpdateWithOffset is returned when archiving messages with Options.Update
+	// along with Options.Skip or Options.LastID, which it would ignore.
+	ErrUpdateWithOffset = errors.New("error, update can not be used with skip or lastID")
 )
 
 var numdownloadtokens = 3
@@ -54,19 +60,104 @@ type Options struct {
 	// LastID is the id of the item to retrieve items before or after.
 	// Applies to: ArchiveChannel, ArchiveMembers.
 	LastID string // default: ""
+
+	// SaveGuildImages enables saving a guild's icon, banner,
+	// splash and discovery splash images to disk.
+	// Applies to: ArchiveGuild, ArchiveChannel.
+	SaveGuildImages bool // default: false
+
+	// SaveEmojis enables saving the images of a guild's custom emojis
+	// and stickers, and of stickers sent in messages, to disk.
+	// Applies to: ArchiveGuild, ArchiveChannel.
+	SaveEmojis bool // default: false
+
+	// SaveReactionUsers enables saving the users who added each reaction.
+	// This requires an additional request for every reaction on a message,
+	// and a client with MessageReactions; other clients return ErrUnsupportedClient.
+	// Sinks other than an SQLSink log a warning and do not save them.
+	// Applies to: ArchiveGuild, ArchiveChannel.
+	SaveReactionUsers bool // default: false
+
+	// Update only archives messages newer than the newest message
+	// already stored for the channel. Channels that have not been
+	// archived before are archived in full. It can not be used with
+	// Skip or LastID, which return ErrUpdateWithOffset.
+	// Applies to: ArchiveGuild, ArchiveChannel.
+	Update bool // default: false
+
+	// ChannelTypes is the set of channel types archived by ArchiveGuild.
+	// If nil, DefaultChannelTypes is used.
+	// Applies to: ArchiveGuild.
+	ChannelTypes map[discordgo.ChannelType]bool // default: nil
+
+	// IncludeThreads enables archiving the active and archived threads
+	// of text and announcement channels.
+	// Applies to: ArchiveGuild, ArchiveChannel.
+	IncludeThreads bool // default: false
+
+	// Backfill continues archiving messages older than the oldest stored
+	// message when used with Update, until the start of the channel is reached.
+	// Applies to: ArchiveGuild, ArchiveChannel.
+	Backfill bool // default: false
+
+	// Reconcile re-walks the messages that have already been archived
+	// before archiving new ones, marking messages that no longer exist as
+	// deleted and storing a revision of messages that were edited.
+	// Applies to: ArchiveGuild, ArchiveChannel.
+	Reconcile bool // default: false
+
+	// ChannelConcurrency is the number of channels ArchiveGuild fetches
+	// messages from at once. Values below 2 archive channels one at a time.
+	// Applies to: ArchiveGuild.
+	ChannelConcurrency int // default: 1
+
+	// BlobStorage stores downloaded attachments and embed images once per
+	// content under blobs/<sha256 prefix>/<sha256> in the archiver's storage,
+	// so that files posted many times are only stored once.
+	// Applies to: ArchiveGuild, ArchiveChannel.
+	BlobStorage bool // default: false
+}
+
+// DefaultChannelTypes are the guild channel types that contain messages.
+// Forum and media channels contain posts, which are archived as threads.
+var DefaultChannelTypes = map[discordgo.ChannelType]bool{
+	discordgo.ChannelTypeGuildText:       true,
+	discordgo.ChannelTypeGuildNews:       true,
+	discordgo.ChannelTypeGuildVoice:      true,
+	discordgo.ChannelTypeGuildStageVoice: true,
+	discordgo.ChannelTypeGuildForum:      true,
+	discordgo.ChannelTypeGuildMedia:      true,
+}
+
+// archivesType reports whether channels of the given type should be archived.
+func (opt *Options) archivesType(t discordgo.ChannelType) bool {
+	if opt.ChannelTypes == nil {
+		return DefaultChannelTypes[t]
+	}
+	return opt.ChannelTypes[t]
 }
 
 // NewOptions returns a pointer to an options struct initialized with the
 // default values.
 func NewOptions() *Options {
 	opt := &Options{
-		SaveAttachments: false,
-		SaveEmbedImages: false,
-		SaveAvatars:     false,
-		AvatarSize:      "",
-		Limit:           0,
-		Skip:            0,
-		LastID:          "",
+		SaveAttachments:    false,
+		SaveEmbedImages:    false,
+		SaveAvatars:        false,
+		AvatarSize:         "",
+		Limit:              0,
+		Skip:               0,
+		LastID:             "",
+		SaveGuildImages:    false,
+		SaveEmojis:         false,
+		SaveReactionUsers:  false,
+		ChannelTypes:       nil,
+		IncludeThreads:     false,
+		Update:             false,
+		Backfill:           false,
+		Reconcile:          false,
+		ChannelConcurrency: 1,
+		BlobStorage:        false,
 	}
 	return opt
 }
@@ -81,8 +172,33 @@ type Archiver struct {
 	// Defaults to './'
 	SavePath string
 
+	// Storage is where downloaded files are stored.
+	// Defaults to the local filesystem at SavePath
+	Storage Storage
+
+	// Dialect is the SQL dialect of the database archived to.
+	// Databases other than SQLite must be opened with Open.
+	// Defaults to SQLite
+	Dialect Dialect
+
+	// DownloadRetries is the number of times a download is retried after
+	// a server error, a rate limit or a timeout.
+	// Defaults to 3
+	DownloadRetries int
+
+	// DownloadBackoff is the delay before the first retry of a download.
+	// The delay doubles with each retry and is randomized by up to half
+	// in either direction. A Retry-After header sent by the server is used
+	// instead when it is longer.
+	// Defaults to one second
+	DownloadBackoff time.Duration
+
 	// limits the amount of actively downloading files
 	downloadTokens chan struct{}
+	// runs downloads and records their results
+	downloads *downloadManager
+	// statements prepared on transactions that have not ended
+	stmts *stmtCache
 	// custom http client for downloading files
 	httpclient *http.Client
 }
@@ -90,9 +206,14 @@ type Archiver struct {
 // New returns a new archiver
 func New() *Archiver {
 	a := &Archiver{
-		Log:            nil,
-		SavePath:       "./",
-		downloadTokens: make(chan struct{}, numdownloadtokens),
+		Log:             nil,
+		SavePath:        "./",
+		Dialect:         SQLite,
+		DownloadRetries: 3,
+		DownloadBackoff: time.Second,
+		downloadTokens:  make(chan struct{}, numdownloadtokens),
+		downloads:       newDownloadManager(),
+		stmts:           newStmtCache(),
 		httpclient: &http.Client{
 			Timeout: time.Second * 15,
 		},
@@ -104,6 +225,14 @@ func New() *Archiver {
 	return a
 }
 
+// storage returns the storage downloaded files are stored in.
+func (a *Archiver) storage() Storage {
+	if a.Storage != nil {
+		return a.Storage
+	}
+	return NewLocalStorage(a.SavePath)
+}
+
 func (a *Archiver) logf(str string, args ...interface{}) {
 	if a.Log != nil {
 		fmt.Fprintf(a.Log, str+"\n", args...)
@@ -116,99 +245,79 @@ func (a *Archiver) log(args ...interface{}) {
 	}
 }
 
-// InitDB initializes the database with the required tables
+// dialect returns the dialect of the database, defaulting to SQLite.
+func (a *Archiver) dialect() Dialect {
+	if a.Dialect == nil {
+		return SQLite
+	}
+	return a.Dialect
+}
+
+// InitDB initializes the database with the required tables,
+// migrating databases created by older versions to the current schema.
+// Returns ErrSchemaTooNew if the database was created by a newer version.
 func (a *Archiver) InitDB(tx *sql.Tx, opt *Options) error {
 	if opt == nil {
 		opt = NewOptions()
 	}
-	_, err := tx.Exec(
-		"CREATE TABLE IF NOT EXISTS messages(" +
-			"channelID TEXT, " +
-			"messageID TEXT, " +
-			"userID TEXT, " +
-			"username TEXT, " +
-			"avatar TEXT, " +
-			"content TEXT, " +
-			"mentionsJSON TEXT, " +
-			"embedsJSON TEXT, " +
-			"attachmentsJSON TEXT, " +
-			"UNIQUE(channelID, messageID))",
-	)
+	_, _, err := a.Migrate(tx)
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec(
-		"CREATE TABLE IF NOT EXISTS channels(" +
-			"channelID TEXT NOT NULL UNIQUE, " +
-			"guildID TEXT, " +
-			"name TEXT, " +
-			"topic TEXT, " +
-			"type INT, " +
-			"channelJSON TEXT)",
-	)
-	if err != nil {
-		return err
+	// Create attachments and embeds folder.
+	if a.Storage == nil && (opt.SaveAttachments ||
+		opt.SaveEmbedImages ||
+		opt.SaveAvatars ||
+		opt.SaveEmojis ||
+		opt.SaveGuildImages) {
+		err = os.MkdirAll(a.SavePath, 0755)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = tx.Exec(
-		"CREATE TABLE IF NOT EXISTS guilds(" +
-			"guildID TEXT NOT NULL UNIQUE, " +
-			"name TEXT, " +
-			"guildJSON TEXT)",
-	)
-	if err != nil {
-		return err
-	}
+	return nil
+}
 
-	_, err = tx.Exec(
-		"CREATE TABLE IF NOT EXISTS files(" +
-			"channelID TEXT, " +
-			"messageID TEXT, " +
-			"path TEXT UNIQUE)",
-	)
+// InsertGuild inserts or updates a guild into the database
+func (a *Archiver) InsertGuild(tx *sql.Tx, guild *discordgo.Guild) error {
+	guildJSON, err := json.Marshal(guild)
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec(
-		"CREATE TABLE IF NOT EXISTS avatarfiles(" +
-			"userID TEXT UNIQUE, " +
-			"path TEXT UNIQUE)",
-	)
-	if err != nil {
-		return err
-	}
+	_, err = a.exec(tx, upsertSQL("guilds", "guildID", guildColumns), guild.ID, guild.Name, string(guildJSON))
+	return err
+}
 
-	_, err = tx.Exec(
-		"CREATE TABLE IF NOT EXISTS members(" +
-			"guildID TEXT, " +
-			"userID TEXT, " +
-			"username TEXT, " +
-			"nickname TEXT, " +
-			"rolesJSON TEXT, " +
-			"UNIQUE(guildID, userID)" +
-			")",
-	)
+// InsertRoles inserts or updates the roles of a guild.
+func (a *Archiver) InsertRoles(tx *sql.Tx, guildID string, roles []*discordgo.Role) error {
+	defer a.scope(tx)()
+
+	smt, err := a.prepare(tx, upsertSQL("roles", "guildID, roleID", roleColumns))
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec(
-		"CREATE TABLE IF NOT EXISTS users(" +
-			"userID TEXT UNIQUE, " +
-			"username TEXT, " +
-			"avatar TEXT, " +
-			"discriminator TEXT, " +
-			"verified INT" +
-			")",
-	)
+	for _, r := range roles {
+		roleJSON, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
 
-	// Create attachments and embeds folder.
-	if opt.SaveAttachments ||
-		opt.SaveEmbedImages ||
-		opt.SaveAvatars {
-		err = os.MkdirAll(a.SavePath, 0600)
+		_, err = smt.Exec(
+			guildID,
+			r.ID,
+			r.Name,
+			r.Color,
+			r.Position,
+			boolToInt(r.Hoist),
+			r.Permissions,
+			boolToInt(r.Mentionable),
+			boolToInt(r.Managed),
+			string(roleJSON),
+		)
 		if err != nil {
 			return err
 		}
@@ -217,58 +326,125 @@ func (a *Archiver) InitDB(tx *sql.Tx, opt *Options) error {
 	return nil
 }
 
-// InsertGuild inserts or updates a guild into the database
-func (a *Archiver) InsertGuild(tx *sql.Tx, guild *discordgo.Guild) error {
-	guildJSON, err := json.Marshal(guild)
+// InsertChannel inserts a channel into the database
+func (a *Archiver) InsertChannel(tx *sql.Tx, channel *discordgo.Channel) error {
+	channelJSON, err := json.Marshal(channel)
 	if err != nil {
 		return err
 	}
 
-	smt, err := tx.Prepare("INSERT or REPLACE INTO guilds VALUES(?, ?, ?)")
-	if err != nil {
-		return err
+	// Thread information
+	var (
+		archived            int
+		autoArchiveDuration int
+	)
+	if channel.ThreadMetadata != nil {
+		archived = boolToInt(channel.ThreadMetadata.Archived)
+		autoArchiveDuration = channel.ThreadMetadata.AutoArchiveDuration
 	}
-	if _, err = smt.Exec(guild.ID, guild.Name, string(guildJSON)); err != nil {
-		return err
+
+	// Insert channel information into database
+	// Columns that are not set here, such as the tags of forum posts,
+	// are kept when the channel is updated.
+	_, err = a.exec(tx,
+		"INSERT INTO channels(channelID, guildID, name, topic, type, channelJSON, parentID, ownerID, archived, autoArchiveDuration, icon) "+
+			"VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) "+
+			"ON CONFLICT(channelID) DO UPDATE SET "+
+			"guildID=excluded.guildID, name=excluded.name, topic=excluded.topic, type=excluded.type, "+
+			"channelJSON=excluded.channelJSON, parentID=excluded.parentID, ownerID=excluded.ownerID, "+
+			"archived=excluded.archived, autoArchiveDuration=excluded.autoArchiveDuration, icon=excluded.icon",
+		channel.ID,
+		channel.GuildID,
+		channel.Name,
+		channel.Topic,
+		int(channel.Type),
+		string(channelJSON),
+		channel.ParentID,
+		channel.OwnerID,
+		archived,
+		autoArchiveDuration,
+		channel.Icon,
+	)
+	if err != nil {
+		return ErrNotUnique
 	}
 
 	return nil
 }
 
-// InsertChannel inserts a channel into the database
-func (a *Archiver) InsertChannel(tx *sql.Tx, channel *discordgo.Channel) error {
-	channelJSON, err := json.Marshal(channel)
+// InsertRecipients inserts the recipients of a direct message channel
+// into the recipients and users tables.
+func (a *Archiver) InsertRecipients(tx *sql.Tx, channel *discordgo.Channel) error {
+	defer a.scope(tx)()
+
+	smt, err := a.prepare(tx, upsertSQL("recipients", "channelID, userID", "channelID, userID"))
 	if err != nil {
 		return err
 	}
 
-	// Insert channel information into database
-	smt, err := tx.Prepare("INSERT or REPLACE INTO channels VALUES(?, ?, ?, ?, ?, ?)")
+	for _, usr := range channel.Recipients {
+		if _, err = smt.Exec(channel.ID, usr.ID); err != nil {
+			return err
+		}
+		if err = a.InsertUser(tx, usr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InsertMessage inserts a message into the database along with its reactions and stickers.
+//
+// Deprecated: s, guildID and opt are unused. Use InsertMessages, which inserts
+// msg as a page of one message.
+func (a *Archiver) InsertMessage(s DiscordClient, guildID string, tx *sql.Tx, msg *discordgo.Message, opt *Options) error {
+	return a.InsertMessages(tx, []*discordgo.Message{msg})
+}
+
+// InsertMessages inserts a page of messages into the database, along with
+// their reactions and stickers. The messages are written with multi-row
+// inserts, which is much faster than inserting them one at a time.
+// Messages that are already archived are left unchanged, so that pages
+// overlapping the archived range do not fail.
+func (a *Archiver) InsertMessages(tx *sql.Tx, msgs []*discordgo.Message) error {
+	defer a.scope(tx)()
+
+	rows := make([][]interface{}, len(msgs))
+	for i, msg := range msgs {
+		rows[i] = messageRow(msg)
+	}
+
+	err := a.insertRows(tx, "messages", messageColumns, "ON CONFLICT(channelID, messageID) DO NOTHING", rows)
 	if err != nil {
 		return err
 	}
 
-	_, err = smt.Exec(channel.ID, channel.GuildID, channel.Name, channel.Topic, int(channel.Type), string(channelJSON))
-	if err != nil {
-		return ErrNotUnique
+	for _, msg := range msgs {
+		err = a.InsertReactions(tx, msg)
+		if err != nil {
+			return err
+		}
+
+		err = a.InsertMessageStickers(tx, msg)
+		if err != nil {
+			return err
+		}
 	}
-	smt.Close()
 
 	return nil
 }
 
-// InsertMessage inserts a message into the database
-func (a *Archiver) InsertMessage(s *discordgo.Session, guildID string, tx *sql.Tx, msg *discordgo.Message, opt *Options) error {
+// messageRow returns the values of the messageColumns of a message.
+func messageRow(msg *discordgo.Message) []interface{} {
 	var (
 		attachmentsJSON string
 		embedsJSON      string
 		mentionsJSON    string
+		snapshotsJSON   string
+		ref             = &discordgo.MessageReference{}
 	)
 
-	if opt == nil {
-		opt = NewOptions()
-	}
-
 	if a, err := json.Marshal(msg.Attachments); err == nil {
 		attachmentsJSON = string(a)
 	}
@@ -278,13 +454,20 @@ func (a *Archiver) InsertMessage(s *discordgo.Session, guildID string, tx *sql.T
 	if e, err := json.Marshal(msg.Mentions); err == nil {
 		mentionsJSON = string(e)
 	}
+	if e, err := json.Marshal(msg.MessageSnapshots); err == nil {
+		snapshotsJSON = string(e)
+	}
+	if msg.MessageReference != nil {
+		ref = msg.MessageReference
+	}
 
-	smt, err := tx.Prepare("INSERT INTO messages VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)")
-	if err != nil {
-		return err
+	var editedTimestamp sql.NullString
+	if msg.EditedTimestamp != nil {
+		editedTimestamp.String = formatTimestamp(*msg.EditedTimestamp)
+		editedTimestamp.Valid = true
 	}
-	defer smt.Close()
-	if _, err = smt.Exec(
+
+	return []interface{}{
 		msg.ChannelID,
 		msg.ID,
 		msg.Author.ID,
@@ -294,13 +477,116 @@ func (a *Archiver) InsertMessage(s *discordgo.Session, guildID string, tx *sql.T
 		mentionsJSON,
 		embedsJSON,
 		attachmentsJSON,
-	); err != nil {
+		formatTimestamp(msg.Timestamp),
+		editedTimestamp,
+		int(msg.Type),
+		int(msg.Flags),
+		boolToInt(msg.TTS),
+		boolToInt(msg.Pinned),
+		boolToInt(msg.MentionEveryone),
+		int(ref.Type),
+		ref.ChannelID,
+		ref.MessageID,
+		ref.GuildID,
+		snapshotsJSON,
+	}
+}
+
+// InsertReactions inserts or updates the reactions of a message.
+func (a *Archiver) InsertReactions(tx *sql.Tx, msg *discordgo.Message) error {
+	if len(msg.Reactions) == 0 {
+		return nil
+	}
+	defer a.scope(tx)()
+
+	smt, err := a.prepare(tx, upsertSQL("reactions",
+		"channelID, messageID, emojiID, emojiName",
+		"channelID, messageID, emojiID, emojiName, animated, count",
+	))
+	if err != nil {
 		return err
 	}
 
+	for _, r := range msg.Reactions {
+		if r.Emoji == nil {
+			continue
+		}
+		_, err = smt.Exec(msg.ChannelID, msg.ID, r.Emoji.ID, r.Emoji.Name, boolToInt(r.Emoji.Animated), r.Count)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// InsertReactionUser records that a user added a reaction to a message.
+func (a *Archiver) InsertReactionUser(tx *sql.Tx, channelID, messageID string, emoji *discordgo.Emoji, userID string) error {
+	_, err := a.addReactionUser(tx, channelID, messageID, emoji, userID)
+	return err
+}
+
+// addReactionUser records that a user added a reaction to a message,
+// and reports whether the user had not been recorded yet.
+func (a *Archiver) addReactionUser(tx *sql.Tx, channelID, messageID string, emoji *discordgo.Emoji, userID string) (bool, error) {
+	res, err := a.exec(tx, upsertSQL("reaction_users",
+		"channelID, messageID, emojiID, emojiName, userID",
+		"channelID, messageID, emojiID, emojiName, userID",
+	), channelID, messageID, emoji.ID, emoji.Name, userID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// BackfillTimestamps fills in the timestamps of stored messages that have none
+// by decoding them from their snowflake IDs. It returns the number of messages updated.
+func (a *Archiver) BackfillTimestamps(tx *sql.Tx) (int, error) {
+	defer a.scope(tx)()
+
+	rows, err := tx.Query("SELECT channelID, messageID FROM messages WHERE timestamp IS NULL OR timestamp=''")
+	if err != nil {
+		return 0, err
+	}
+
+	type key struct{ channelID, messageID string }
+	var keys []key
+	for rows.Next() {
+		var k key
+		if err = rows.Scan(&k.channelID, &k.messageID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	smt, err := a.prepare(tx, "UPDATE messages SET timestamp=? WHERE channelID=? AND messageID=?")
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, k := range keys {
+		t, err := discordgo.SnowflakeTimestamp(k.messageID)
+		if err != nil {
+			a.logf("[error] error decoding timestamp of message [%s]: %s", k.messageID, err.Error())
+			continue
+		}
+		if _, err = smt.Exec(formatTimestamp(t), k.channelID, k.messageID); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
 // InsertMember inserts a member into the members table.
 func (a *Archiver) InsertMember(tx *sql.Tx, m *discordgo.Member) error {
 
@@ -309,233 +595,189 @@ func (a *Archiver) InsertMember(tx *sql.Tx, m *discordgo.Member) error {
 		rolesJSON = string(j)
 	}
 
-	smt, err := tx.Prepare("INSERT OR REPLACE INTO members VALUES(?, ?, ?, ?, ?)")
-	if err != nil {
-		return err
-	}
-	defer smt.Close()
-	_, err = smt.Exec(m.GuildID, m.User.ID, m.User.Username, m.Nick, rolesJSON)
+	_, err := a.exec(tx, upsertSQL("members", "guildID, userID", "guildID, userID, username, nickname, rolesJSON"),
+		m.GuildID, m.User.ID, m.User.Username, m.Nick, rolesJSON)
 
 	return err
 }
 
 // InsertUser inserts a user into the users table.
 func (a *Archiver) InsertUser(tx *sql.Tx, usr *discordgo.User) error {
-	smt, err := tx.Prepare("INSERT OR REPLACE INTO users VALUES(?, ?, ?, ?, ?)")
-	if err != nil {
-		return err
-	}
-	defer smt.Close()
-
-	var verified int
-	if usr.Verified {
-		verified = 1
-	} else {
-		verified = 0
-	}
-
-	_, err = smt.Exec(usr.ID, usr.Username, usr.AvatarURL(""), usr.Discriminator, verified)
+	_, err := a.exec(tx, upsertSQL("users", "userID", "userID, username, avatar, discriminator, verified"),
+		usr.ID, usr.Username, usr.AvatarURL(""), usr.Discriminator, boolToInt(usr.Verified))
 
 	return err
 }
 
 // InsertFile inserts a file into the database
 func (a *Archiver) InsertFile(tx *sql.Tx, channelID, messageID, path string) error {
-	smt, err := tx.Prepare("INSERT INTO files VALUES(?, ?, ?)")
-	if err != nil {
-		return err
-	}
-	defer smt.Close()
-	_, err = smt.Exec(messageID, channelID, path)
+	_, err := a.exec(tx, "INSERT INTO files(channelID, messageID, path) VALUES(?, ?, ?)", channelID, messageID, path)
 	if err != nil {
 		return errors.New("[error] error inserting file " + path + " " + err.Error())
 	}
 	return nil
 }
 
-func (a *Archiver) downloadAttachments(tx *sql.Tx, msg *discordgo.Message) error {
-	if len(msg.Attachments) != 0 {
-		os.MkdirAll(filepath.Join(a.SavePath, "attachments", msg.ChannelID), 0600)
-	}
-
-	for i, v := range msg.Attachments {
-		pathA := filepath.Join("attachments", msg.ChannelID, fmt.Sprintf("%s-%d-%s", msg.ID, i, v.Filename))
-		path := filepath.Join(a.SavePath, pathA)
-
-		resp, err := http.Get(v.URL)
-		if err != nil {
-			a.logf("[error] error downloading attachment [%s] for message [%s]", v.Filename, msg.ID)
-			return nil
-		}
-		defer resp.Body.Close()
-
-		err = a.InsertFile(tx, msg.ChannelID, msg.ID, pathA)
-		if err != nil {
-			return err
-		}
-
-		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+// downloadAttachments queues the attachments of a message to be downloaded.
+func (a *Archiver) downloadAttachments(ctx context.Context, sink Sink, msg *discordgo.Message, opt *Options) error {
+	for i := range msg.Attachments {
+		err := a.downloadAttachment(ctx, sink, msg, i, opt)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-		io.Copy(f, resp.Body)
 	}
 
 	return nil
 }
 
-func (a *Archiver) downloadEmbeds(tx *sql.Tx, msg *discordgo.Message) error {
-	if len(msg.Embeds) != 0 {
-		os.MkdirAll(filepath.Join(a.SavePath, "embeds", msg.ChannelID), 0600)
-	}
+// downloadAttachment queues the attachment of a message at index i to be downloaded.
+func (a *Archiver) downloadAttachment(ctx context.Context, sink Sink, msg *discordgo.Message, i int, opt *Options) error {
+	v := msg.Attachments[i]
+	f := &File{ChannelID: msg.ChannelID, MessageID: msg.ID, Index: i, Kind: FileAttachment, URL: v.URL}
+	return a.downloadFile(ctx, sink, f, func(mime string) string {
+		return filepath.Join("attachments", msg.ChannelID, fmt.Sprintf("%s-%d-%s", msg.ID, f.Index, v.Filename))
+	}, opt)
+}
 
+// downloadEmbeds queues the images and thumbnails of a message's embeds to be downloaded.
+func (a *Archiver) downloadEmbeds(ctx context.Context, sink Sink, msg *discordgo.Message, opt *Options) error {
 	for i, v := range msg.Embeds {
 		if v.Image != nil && v.Image.URL != "" {
-
-			resp, err := a.httpclient.Get(v.Image.URL)
+			err := a.downloadEmbedFile(ctx, sink, msg, i, FileEmbedImage, opt)
 			if err != nil {
 				return err
 			}
-			defer resp.Body.Close()
-
-			// Infer the file type
-			sample := make([]byte, 512)
-			nread, err := resp.Body.Read(sample)
-			if err != nil {
-				return err
-			}
-			extension := strings.Split(http.DetectContentType(sample[:nread]), "/")[1]
-
-			if len(extension) <= 4 {
-
-				pathA := filepath.Join("embeds", msg.ChannelID, fmt.Sprintf("%s-%d.%s", msg.ID, i, extension))
-				path := filepath.Join(a.SavePath, pathA)
-
-				err = a.InsertFile(tx, msg.ChannelID, msg.ID, pathA)
-				if err != nil {
-					return err
-				}
-
-				f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
-				if err != nil {
-					return err
-				}
-				defer f.Close()
-
-				// Write the sample bytes to the file
-				_, err = f.Write(sample[:nread])
-				if err != nil {
-					return err
-				}
-				_, err = io.Copy(f, resp.Body)
-				if err != nil {
-					return err
-				}
-			}
-			resp.Body.Close()
 		}
 
 		if v.Thumbnail != nil && v.Thumbnail.URL != "" {
-			resp, err := a.httpclient.Get(v.Thumbnail.URL)
-			if err != nil {
-				return err
-			}
-			defer resp.Body.Close()
-
-			// Infer the file type
-			sample := make([]byte, 512)
-			nread, err := resp.Body.Read(sample)
+			err := a.downloadEmbedFile(ctx, sink, msg, i, FileEmbedThumbnail, opt)
 			if err != nil {
 				return err
 			}
-			extension := strings.Split(http.DetectContentType(sample[:nread]), "/")[1]
-
-			if len(extension) <= 4 {
-				pathA := filepath.Join("embeds", msg.ChannelID, fmt.Sprintf("%s-%d-thumb.%s", msg.ID, i, extension))
-				path := filepath.Join(a.SavePath, pathA)
-
-				err = a.InsertFile(tx, msg.ChannelID, msg.ID, pathA)
-				if err != nil {
-					return err
-				}
-
-				f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
-				if err != nil {
-					return err
-				}
-				defer f.Close()
-
-				// Write the sample bytes to the file
-				_, err = f.Write(sample[:nread])
-				if err != nil {
-					return err
-				}
-				_, err = io.Copy(f, resp.Body)
-				if err != nil {
-					return err
-				}
-			}
 		}
 	}
 	return nil
 }
 
+// downloadEmbedFile queues the image or thumbnail of the embed of a message
+// at index i to be downloaded. kind is FileEmbedImage or FileEmbedThumbnail.
+func (a *Archiver) downloadEmbedFile(ctx context.Context, sink Sink, msg *discordgo.Message, i int, kind string, opt *Options) error {
+	var url, suffix string
+	if kind == FileEmbedThumbnail {
+		url, suffix = msg.Embeds[i].Thumbnail.URL, "-thumb"
+	} else {
+		url = msg.Embeds[i].Image.URL
+	}
+
+	f := &File{ChannelID: msg.ChannelID, MessageID: msg.ID, Index: i, Kind: kind, URL: url}
+	return a.downloadFile(ctx, sink, f, func(mime string) string {
+		if ext := mimeExtension(mime); ext != "" {
+			return filepath.Join("embeds", msg.ChannelID, fmt.Sprintf("%s-%d%s.%s", msg.ID, f.Index, suffix, ext))
+		}
+		return ""
+	}, opt)
+}
+
 // downloadAvatar downloads a user's avatar.
-func (a *Archiver) downloadAvatar(tx *sql.Tx, usr *discordgo.User, opt *Options) error {
+func (a *Archiver) downloadAvatar(ctx context.Context, w *txWriter, usr *discordgo.User, opt *Options) error {
 	if opt == nil {
 		opt = NewOptions()
 	}
 
-	resp, err := http.Get(usr.AvatarURL(opt.AvatarSize))
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+	return a.downloadAvatarURL(ctx, w, usr.ID, usr.AvatarURL(opt.AvatarSize))
+}
 
-	sample := make([]byte, 512)
-	nsample, err := resp.Body.Read(sample)
+// downloadAvatarURL queues the avatar of a user to be downloaded from url.
+func (a *Archiver) downloadAvatarURL(ctx context.Context, w *txWriter, userID, url string) error {
+	var pathA string
+	return a.queue(&download{
+		ctx:  ctx,
+		w:    w,
+		kind: kindAvatar,
+		id:   userID,
+		url:  url,
+		save: func(resp *http.Response) (int64, error) {
+			body := bufio.NewReaderSize(resp.Body, 512)
+			sample, _ := body.Peek(512)
+			extension := strings.Split(http.DetectContentType(sample), "/")[1]
+
+			pathA = filepath.Join("avatars", fmt.Sprintf("%s.%s", userID, extension))
+			return a.writeFile(pathA, body)
+		},
+		record: func(tx *sql.Tx) error {
+			_, err := tx.Exec(upsertSQL("avatarfiles", "userID", "userID, path"), userID, pathA)
+			return err
+		},
+	})
+}
+
+// insertGuildInfo inserts a guild along with its roles, emojis and stickers.
+func (a *Archiver) insertGuildInfo(tx *sql.Tx, guild *discordgo.Guild) error {
+	err := a.InsertGuild(tx, guild)
 	if err != nil {
 		return err
 	}
-	extension := strings.Split(http.DetectContentType(sample), "/")[1]
-
-	pathA := filepath.Join("avatars", fmt.Sprintf("%s.%s", usr.ID, extension))
-	path := filepath.Join(a.SavePath, pathA)
 
-	os.MkdirAll(filepath.Join(a.SavePath, "avatars"), 0600)
-
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	err = a.InsertRoles(tx, guild.ID, guild.Roles)
 	if err != nil {
 		return err
 	}
 
-	_, err = f.Write(sample[:nsample])
+	err = a.InsertEmojis(tx, guild.ID, guild.Emojis)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(f, resp.Body)
-	if err != nil {
-		return err
+	return a.InsertStickers(tx, guild.ID, guild.Stickers)
+}
+
+// downloadGuildMedia queues the emojis, stickers and images of a guild to be downloaded.
+func (a *Archiver) downloadGuildMedia(ctx context.Context, w *txWriter, guild *discordgo.Guild, opt *Options) error {
+	if opt.SaveEmojis {
+		err := a.downloadGuildEmojis(ctx, w, guild)
+		if err != nil {
+			return err
+		}
 	}
 
-	smt, err := tx.Prepare("INSERT OR REPLACE INTO avatarfiles VALUES(?, ?)")
-	if err != nil {
-		return err
+	if opt.SaveGuildImages {
+		err := a.downloadGuildImages(ctx, w, guild)
+		if err != nil {
+			return err
+		}
 	}
-	defer smt.Close()
 
-	_, err = smt.Exec(usr.ID, pathA)
+	return nil
+}
+
+// putGuild writes a guild to a sink. Its emojis and images are only
+// downloaded for an SQLSink, which records where they were saved.
+func (a *Archiver) putGuild(ctx context.Context, sink Sink, guild *discordgo.Guild, opt *Options) error {
+	err := sink.PutGuild(guild)
 	if err != nil {
 		return err
 	}
 
+	if s, ok := sink.(*SQLSink); ok {
+		return a.downloadGuildMedia(ctx, s.w, guild, opt)
+	}
 	return nil
 }
 
 // ArchiveChannel archives a channel's messages.
-func (a *Archiver) ArchiveChannel(s *discordgo.Session, tx *sql.Tx, channelID string, opt *Options) error {
+// It returns once the files downloaded from the channel have been recorded
+// in tx, so tx can be committed as soon as it returns.
+func (a *Archiver) ArchiveChannel(s DiscordClient, tx *sql.Tx, channelID string, opt *Options) error {
+	return a.ArchiveChannelContext(context.Background(), s, tx, channelID, opt)
+}
+
+// ArchiveChannelContext archives a channel's messages until ctx is done.
+// Once ctx is done no more messages are fetched, and the error of ctx is returned.
+// The messages archived until then are kept in tx, along with the archived
+// range of the channel, so that archiving can be resumed with Options.Update
+// and Options.Backfill. Downloads that were already started are not canceled,
+// but are no longer retried.
+func (a *Archiver) ArchiveChannelContext(ctx context.Context, s DiscordClient, tx *sql.Tx, channelID string, opt *Options) error {
 	if opt == nil {
 		opt = NewOptions()
 	}
@@ -544,138 +786,452 @@ func (a *Archiver) ArchiveChannel(s *discordgo.Session, tx *sql.Tx, channelID st
 		return err
 	}
 
+	sink := a.sqlSink(tx)
+	defer sink.Close()
+	return a.ArchiveChannelToContext(ctx, s, sink, channelID, opt)
+}
+
+// ArchiveChannelTo archives a channel's messages to a sink.
+func (a *Archiver) ArchiveChannelTo(s DiscordClient, sink Sink, channelID string, opt *Options) error {
+	return a.ArchiveChannelToContext(context.Background(), s, sink, channelID, opt)
+}
+
+// ArchiveChannelToContext archives a channel's messages to a sink until ctx is done,
+// as ArchiveChannelContext does.
+func (a *Archiver) ArchiveChannelToContext(ctx context.Context, s DiscordClient, sink Sink, channelID string, opt *Options) error {
+	if opt == nil {
+		opt = NewOptions()
+	}
+
 	// Obtain channel and guild information
-	channel, err := s.Channel(channelID)
+	channel, err := s.Channel(channelID, discordgo.WithContext(ctx))
+	if err != nil {
+		return requestErr(ctx, err)
+	}
+
+	var guild *discordgo.Guild
+	if channel.GuildID != "" {
+		guild, err = s.Guild(channel.GuildID, discordgo.WithContext(ctx))
+		if err != nil {
+			return requestErr(ctx, err)
+		}
+
+		err = a.putGuild(ctx, sink, guild, opt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return a.archiveChannel(ctx, s, sink, guild, &activeThreads{}, channel, opt)
+}
+
+// archiveChannel archives the messages of a channel whose guild
+// information has already been archived. guild is nil for direct messages.
+// active holds the active threads of the guild.
+func (a *Archiver) archiveChannel(ctx context.Context, s DiscordClient, sink Sink, guild *discordgo.Guild, active *activeThreads, channel *discordgo.Channel, opt *Options) error {
+	err := sink.PutChannel(channel)
 	if err != nil {
 		return err
 	}
 
-	err = a.InsertChannel(tx, channel)
+	// Direct messages do not belong to a guild.
+	if guild == nil {
+		return a.archiveMessages(ctx, s, sink, "", channel, opt)
+	}
+
+	// Forum messages are stored in the threads of their posts.
+	if isForum(channel) {
+		return a.archiveForumPosts(ctx, s, sink, active, channel, opt)
+	}
+
+	err = a.archiveMessages(ctx, s, sink, guild.ID, channel, opt)
 	if err != nil {
 		return err
 	}
 
-	guild, err := s.Guild(channel.GuildID)
+	if opt.IncludeThreads && hasThreads(channel) {
+		err = a.archiveThreads(ctx, s, sink, active, channel, opt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// archiveMessages archives the messages of a channel. Sinks that own their
+// transactions commit once the channel is done, even if archiving it failed,
+// so that the next run resumes from its checkpoint.
+func (a *Archiver) archiveMessages(ctx context.Context, s DiscordClient, sink Sink, guildID string, channel *discordgo.Channel, opt *Options) error {
+	if opt.SaveReactionUsers {
+		if _, ok := s.(reactionClient); !ok {
+			return ErrUnsupportedClient
+		}
+		if _, ok := sink.(*SQLSink); !ok {
+			a.logf("[warning] not saving reaction users in channel [%s]: only a database sink saves them", channel.Name)
+		}
+	}
+
+	err := a.fetchMessages(ctx, s, sink, guildID, channel, opt)
+	if sq, ok := sink.(*SQLSink); ok {
+		if cerr := sq.commit(true); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// fetchMessages pages through the messages of a channel, writing them to a sink.
+// Unless opt.Skip or opt.LastID are set, a walk towards the beginning of the
+// channel that was interrupted is resumed from its checkpoint.
+func (a *Archiver) fetchMessages(ctx context.Context, s DiscordClient, sink Sink, guildID string, channel *discordgo.Channel, opt *Options) error {
+	if opt.Update && (opt.Skip > 0 || opt.LastID != "") {
+		return ErrUpdateWithOffset
+	}
+	channelID := channel.ID
+
+	state, err := a.sinkChannelState(sink, channelID)
 	if err != nil {
 		return err
 	}
 
-	err = a.InsertGuild(tx, guild)
+	checkpoint, err := a.sinkCheckpoint(sink, channelID)
 	if err != nil {
 		return err
 	}
 
+	if sq, ok := sink.(*SQLSink); ok && opt.Reconcile {
+		_, err = a.reconcileMessages(ctx, s, sq.w, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	var numArchived int
+
+	// Fetch the messages newer than the newest stored message.
+	if opt.Update && state.NewestID != "" {
+		afterID := state.NewestID
+		for {
+			fetchnum := fetchCount(opt.Limit, numArchived)
+			if fetchnum == 0 {
+				a.logf("[info] reached message limit [%d].", opt.Limit)
+				return nil
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			msgs, err := s.ChannelMessages(channelID, fetchnum, "", afterID, "", discordgo.WithContext(ctx))
+			if err != nil {
+				return requestErr(ctx, err)
+			}
+			if len(msgs) == 0 {
+				break
+			}
+
+			err = a.insertMessages(ctx, s, sink, guildID, channel, msgs, state, opt)
+			if err != nil {
+				return err
+			}
+			numArchived += len(msgs)
+
+			a.logf("[info] archived [%d] new messages in channel [%s] afterID[%s]", numArchived, channel.Name, afterID)
+			afterID = state.NewestID
+
+			if sq, ok := sink.(*SQLSink); ok {
+				err = sq.commit(false)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// An interrupted walk is finished even without opt.Backfill.
+		if (!opt.Backfill && checkpoint == "") || state.Complete {
+			return nil
+		}
+	}
+
 	// Archive channel messages
 	var lastID string
 
+	switch {
+	case opt.Update:
+		lastID = state.OldestID
 	// Skip n messages
-	if opt.Skip > 0 {
-		msg, err := nthChannelMessage(s, channelID, opt.Skip)
+	case opt.Skip > 0:
+		msg, err := nthChannelMessage(ctx, s, channelID, opt.Skip)
 		if err != nil {
 			a.logf("[error] error skipping [%d] messages in channel [%s]: %s", opt.Skip, channel.Name, err.Error())
 			return err
 		}
 		a.logf("[info] skipped [%d] messages in channel [%s]. beforeID[%s]", opt.Skip, channel.Name, msg.ID)
 		lastID = msg.ID
-	} else {
+	case opt.LastID == "" && checkpoint != "":
+		a.logf("[info] resuming channel [%s] from checkpoint beforeID[%s]", channel.Name, checkpoint)
+		lastID = checkpoint
+	default:
 		lastID = opt.LastID
 	}
 
-	var numArchived int
-	for i := 0; ; i++ {
+	for {
 		// Number of messages to fetch
-		var fetchnum int
-		if opt.Limit > 0 {
-			if numArchived >= opt.Limit {
-				a.logf("[info] reached message limit [%d].", opt.Limit)
-				return nil
-			}
+		fetchnum := fetchCount(opt.Limit, numArchived)
+		if fetchnum == 0 {
+			// The checkpoint is kept so that the next run resumes from it.
+			a.logf("[info] reached message limit [%d].", opt.Limit)
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-			fetchnum = opt.Limit - numArchived
-			if fetchnum > 100 {
-				fetchnum = 100
+		msgs, err := s.ChannelMessages(channelID, fetchnum, lastID, "", "", discordgo.WithContext(ctx))
+		if err != nil {
+			return requestErr(ctx, err)
+		}
+		if len(msgs) == 0 {
+			// The beginning of the channel has been reached.
+			state.Complete = true
+			err = a.updateSinkChannelState(sink, state)
+			if err != nil {
+				return err
 			}
-		} else {
-			fetchnum = 100
+			return a.updateSinkCheckpoint(sink, channelID, "")
 		}
 
-		msgs, err := s.ChannelMessages(channelID, fetchnum, lastID, "", "")
+		err = a.insertMessages(ctx, s, sink, guildID, channel, msgs, state, opt)
 		if err != nil {
 			return err
 		}
-		if len(msgs) == 0 {
-			return nil
+		numArchived += len(msgs)
+
+		a.logf("[info] archived [%d] messages in channel [%s] lastID[%s]", numArchived, channel.Name, lastID)
+		lastID = msgs[len(msgs)-1].ID
+
+		err = a.updateSinkCheckpoint(sink, channelID, lastID)
+		if err != nil {
+			return err
 		}
+	}
+}
 
-		numArchived += len(msgs)
+// insertMessages writes a page of messages to a sink, records the
+// new archived range of the channel and starts downloading their files.
+func (a *Archiver) insertMessages(ctx context.Context, s DiscordClient, sink Sink, guildID string, channel *discordgo.Channel, msgs []*discordgo.Message, state *ChannelState, opt *Options) error {
+	for _, msg := range msgs {
+		// Messages fetched from a channel do not carry the ID of its guild.
+		if msg.GuildID == "" {
+			msg.GuildID = guildID
+		}
+	}
 
-		// Insert messages into database
+	// An SQLSink writes the whole page at once.
+	sq, isSQL := sink.(*SQLSink)
+	if isSQL {
+		err := sq.PutMessages(msgs)
+		if err != nil {
+			return err
+		}
+	} else {
 		for _, msg := range msgs {
-			err := a.InsertMessage(s, guild.ID, tx, msg, opt)
+			err := sink.PutMessage(msg)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, msg := range msgs {
+		state.include(msg.ID)
+	}
+
+	err := a.updateSinkChannelState(sink, state)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		if opt.SaveReactionUsers && isSQL {
+			err = a.archiveReactionUsers(ctx, s.(reactionClient), sq, msg)
+			if err != nil {
+				a.logf("[error] error archiving reaction users for message [%s] in channel [%s]: %s", msg.ID, channel.Name, err.Error())
+			}
+		}
+
+		if opt.SaveAttachments {
+			err = a.downloadAttachments(ctx, sink, msg, opt)
+			if err != nil {
+				return err
+			}
+		}
+		if opt.SaveEmbedImages {
+			err = a.downloadEmbeds(ctx, sink, msg, opt)
 			if err != nil {
 				return err
 			}
+		}
+		if opt.SaveEmojis && isSQL && (len(msg.StickerItems) != 0 || customEmojiRegex.MatchString(msg.Content)) {
+			err = sq.w.do(func(tx *sql.Tx) error {
+				return a.insertContentEmojis(tx, msg)
+			})
+			if err != nil {
+				return err
+			}
+			err = a.downloadMessageEmojis(ctx, sq.w, msg)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// archiveReactionUsers archives the users who reacted to a message.
+func (a *Archiver) archiveReactionUsers(ctx context.Context, s reactionClient, sink *SQLSink, msg *discordgo.Message) error {
+	for _, r := range msg.Reactions {
+		if r.Emoji == nil {
+			continue
+		}
 
-			if opt.SaveAttachments {
-				<-a.downloadTokens
-				go func(msg *discordgo.Message) {
-					err = a.downloadAttachments(tx, msg)
+		// Request reaction users in chunks of 100.
+		var afterID string
+		for {
+			users, err := s.MessageReactions(msg.ChannelID, msg.ID, r.Emoji.APIName(), 100, "", afterID, discordgo.WithContext(ctx))
+			if err != nil {
+				return requestErr(ctx, err)
+			}
+			if len(users) == 0 {
+				break
+			}
+
+			err = sink.w.do(func(tx *sql.Tx) error {
+				for _, u := range users {
+					err := a.InsertReactionUser(tx, msg.ChannelID, msg.ID, r.Emoji, u.ID)
 					if err != nil {
-						a.logf("[error] error downloading attachments for message [%s] in channel [%s]: %s", msg.ID, channel.Name, err.Error())
+						return err
 					}
-					a.downloadTokens <- struct{}{}
-				}(msg)
-			}
-			if opt.SaveEmbedImages {
-				<-a.downloadTokens
-				go func(msg *discordgo.Message) {
-					err = a.downloadEmbeds(tx, msg)
+					err = a.InsertUser(tx, u)
 					if err != nil {
-						a.logf("[error] error downloading embeds for message [%s] in channel [%s]: %s", msg.ID, channel.Name, err.Error())
+						return err
 					}
-					a.downloadTokens <- struct{}{}
-				}(msg)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			if len(users) < 100 {
+				break
 			}
+			afterID = users[len(users)-1].ID
 		}
+	}
 
-		a.logf("[info] archived [%d] messages in channel [%s] lastID[%s]", numArchived, channel.Name, lastID)
-		lastID = msgs[len(msgs)-1].ID
+	return nil
+}
+
+// ArchiveGuild archives all the channels in a guild.
+// Channels that fail to archive do not stop the rest of the guild from
+// being archived; their errors are returned together as ChannelErrors.
+// As with ArchiveChannel, the files downloaded from the guild are recorded
+// in tx before it returns.
+func (a *Archiver) ArchiveGuild(s DiscordClient, tx *sql.Tx, guildID string, opt *Options) error {
+	return a.ArchiveGuildContext(context.Background(), s, tx, guildID, opt)
+}
+
+// ArchiveGuildContext archives all the channels in a guild until ctx is done.
+// Once ctx is done no more channels are started, the channels being archived
+// stop fetching messages, and the error of ctx is returned.
+func (a *Archiver) ArchiveGuildContext(ctx context.Context, s DiscordClient, tx *sql.Tx, guildID string, opt *Options) error {
+	if opt == nil {
+		opt = NewOptions()
+	}
+
+	err := a.InitDB(tx, opt)
+	if err != nil {
+		return err
 	}
+
+	sink := a.sqlSink(tx)
+	defer sink.Close()
+	return a.ArchiveGuildToContext(ctx, s, sink, guildID, opt)
+}
+
+// ArchiveGuildTo archives all the channels in a guild to a sink, as ArchiveGuild does.
+func (a *Archiver) ArchiveGuildTo(s DiscordClient, sink Sink, guildID string, opt *Options) error {
+	return a.ArchiveGuildToContext(context.Background(), s, sink, guildID, opt)
 }
 
-// ArchiveGuild archives all the channels in a guild
-func (a *Archiver) ArchiveGuild(s *discordgo.Session, tx *sql.Tx, guildID string, opt *Options) error {
+// ArchiveGuildToContext archives all the channels in a guild to a sink until
+// ctx is done, as ArchiveGuildContext does.
+func (a *Archiver) ArchiveGuildToContext(ctx context.Context, s DiscordClient, sink Sink, guildID string, opt *Options) error {
 	if opt == nil {
 		opt = NewOptions()
 	}
 
-	channels, err := s.GuildChannels(guildID)
+	guild, err := s.Guild(guildID, discordgo.WithContext(ctx))
+	if err != nil {
+		return requestErr(ctx, err)
+	}
+
+	err = a.putGuild(ctx, sink, guild, opt)
 	if err != nil {
 		return err
 	}
 
+	channels, err := s.GuildChannels(guildID, discordgo.WithContext(ctx))
+	if err != nil {
+		return requestErr(ctx, err)
+	}
+
+	var archived []*discordgo.Channel
 	for _, channel := range channels {
-		if channel.Type == discordgo.ChannelTypeGuildText {
-			a.logf("[info] archiving channel [%s] - [%s]", channel.Name, channel.Topic)
-			err = a.ArchiveChannel(s, tx, channel.ID, opt)
-			if err != nil {
-				a.log("[error] error archiving channel: ", err)
-			}
+		if opt.archivesType(channel.Type) {
+			archived = append(archived, channel)
 		}
 	}
+
+	errs := a.archiveChannels(ctx, s, sink, guild, archived, opt)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(errs) != 0 {
+		return errs
+	}
 	return nil
 }
 
-// ArchiveMembers archives the members of a guild
-func (a *Archiver) ArchiveMembers(s *discordgo.Session, tx *sql.Tx, guildID string, opt *Options) error {
+// ArchiveMembers archives the members of a guild.
+// It returns once the avatars it downloads have been recorded in tx.
+func (a *Archiver) ArchiveMembers(s DiscordClient, tx *sql.Tx, guildID string, opt *Options) error {
+	return a.ArchiveMembersContext(context.Background(), s, tx, guildID, opt)
+}
+
+// ArchiveMembersContext archives the members of a guild until ctx is done.
+func (a *Archiver) ArchiveMembersContext(ctx context.Context, s DiscordClient, tx *sql.Tx, guildID string, opt *Options) error {
 	err := a.InitDB(tx, nil)
 	if err != nil {
 		return err
 	}
 
+	sink := a.sqlSink(tx)
+	defer sink.Close()
+	return a.ArchiveMembersToContext(ctx, s, sink, guildID, opt)
+}
+
+// ArchiveMembersTo archives the members of a guild to a sink.
+func (a *Archiver) ArchiveMembersTo(s DiscordClient, sink Sink, guildID string, opt *Options) error {
+	return a.ArchiveMembersToContext(context.Background(), s, sink, guildID, opt)
+}
+
+// ArchiveMembersToContext archives the members of a guild to a sink until ctx is done.
+func (a *Archiver) ArchiveMembersToContext(ctx context.Context, s DiscordClient, sink Sink, guildID string, opt *Options) error {
 	var lastID string
 	if opt.Skip > 0 {
-		m, err := nthGuildMember(s, guildID, opt.Skip)
+		m, err := nthGuildMember(ctx, s, guildID, opt.Skip)
 		if err != nil {
 			return err
 		}
@@ -684,13 +1240,19 @@ func (a *Archiver) ArchiveMembers(s *discordgo.Session, tx *sql.Tx, guildID stri
 		lastID = opt.LastID
 	}
 
+	sq, isSQL := sink.(*SQLSink)
+
 	var count int
 	// Request guild member info in chunks of 1000.
 	for {
-		members, err := s.GuildMembers(guildID, lastID, 1000)
-		if err != nil {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
+
+		members, err := s.GuildMembers(guildID, lastID, 1000, discordgo.WithContext(ctx))
+		if err != nil {
+			return requestErr(ctx, err)
+		}
 		if len(members) == 0 {
 			break
 		}
@@ -700,24 +1262,20 @@ func (a *Archiver) ArchiveMembers(s *discordgo.Session, tx *sql.Tx, guildID stri
 
 		for _, m := range members {
 			m.GuildID = guildID
-			err = a.InsertMember(tx, m)
+			err = sink.PutMember(m)
 			if err != nil {
 				return err
 			}
-			err = a.InsertUser(tx, m.User)
+			err = sink.PutUser(m.User)
 			if err != nil {
 				return err
 			}
 
-			if opt.SaveAvatars {
-				<-a.downloadTokens
-				go func(m *discordgo.Member) {
-					err := a.downloadAvatar(tx, m.User, opt)
-					if err != nil {
-						a.logf("[error] error downloading avatar for user [%s]: %s", m.User.Username, err.Error())
-					}
-					a.downloadTokens <- struct{}{}
-				}(m)
+			if opt.SaveAvatars && isSQL {
+				err = a.downloadAvatar(ctx, sq.w, m.User, opt)
+				if err != nil {
+					return err
+				}
 			}
 		}
 
@@ -0,0 +1,148 @@
+package discordtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func testFake() (*Fake, *discordgo.Channel) {
+	f := NewFake()
+	f.AddGuild(&discordgo.Guild{ID: "1", Name: "guild"})
+	channel := &discordgo.Channel{ID: "2", GuildID: "1", Name: "general", Type: discordgo.ChannelTypeGuildText}
+	f.AddChannel(channel)
+	f.AddMessages(Messages(channel, &discordgo.User{ID: "3", Username: "author"}, 0, 250)...)
+	return f, channel
+}
+
+// walk pages through the messages of a channel from the newest to the oldest,
+// as archiving does, and returns their contents.
+func walk(t *testing.T, channelMessages func(channelID string, limit int, beforeID, afterID, aroundID string, options ...discordgo.RequestOption) ([]*discordgo.Message, error), channelID string) []string {
+	var (
+		contents []string
+		beforeID string
+	)
+	for {
+		msgs, err := channelMessages(channelID, 100, beforeID, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 0 {
+			return contents
+		}
+		for _, msg := range msgs {
+			contents = append(contents, msg.Content)
+		}
+		beforeID = msgs[len(msgs)-1].ID
+	}
+}
+
+func TestFakeChannelMessages(t *testing.T) {
+	f, channel := testFake()
+
+	contents := walk(t, f.ChannelMessages, channel.ID)
+	if len(contents) != 250 || contents[0] != "message 249" || contents[249] != "message 0" {
+		t.Fatalf("walked %d messages from %q, want 250 from %q", len(contents), contents[0], "message 249")
+	}
+
+	all, _ := f.ChannelMessages(channel.ID, 100, "", "", "")
+	after, err := f.ChannelMessages(channel.ID, 10, "", all[20].ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 10 || after[0].Content != "message 239" || after[9].Content != "message 230" {
+		t.Fatalf("got %d messages after %q, want messages 239 to 230", len(after), all[20].Content)
+	}
+
+	around, _ := f.ChannelMessages(channel.ID, 10, "", "", all[50].ID)
+	if len(around) != 10 || around[0].Content != "message 203" {
+		t.Fatalf("got %d messages around %q starting at %q", len(around), all[50].Content, around[0].Content)
+	}
+
+	f.DeleteMessage(channel.ID, all[0].ID)
+	newest, _ := f.ChannelMessages(channel.ID, 1, "", "", "")
+	if newest[0].Content != "message 248" {
+		t.Fatalf("newest message is %q after deleting %q", newest[0].Content, all[0].Content)
+	}
+
+	if _, err = f.Channel("4"); err == nil {
+		t.Fatal("expected an error for an unknown channel")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = f.ChannelMessages(channel.ID, 100, "", "", "", discordgo.WithContext(ctx)); err != context.Canceled {
+		t.Fatalf("got %v for a canceled request, want %v", err, context.Canceled)
+	}
+}
+
+func TestFakeGuildMembers(t *testing.T) {
+	f := NewFake()
+	f.AddGuild(&discordgo.Guild{ID: "1"})
+	for _, id := range []string{"30", "100", "20", "10"} {
+		f.AddMembers("1", &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: id}})
+	}
+
+	var ids []string
+	afterID := ""
+	for {
+		members, err := f.GuildMembers("1", afterID, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(members) == 0 {
+			break
+		}
+		for _, m := range members {
+			ids = append(ids, m.User.ID)
+		}
+		afterID = members[len(members)-1].User.ID
+	}
+	if len(ids) != 4 || ids[0] != "10" || ids[3] != "100" {
+		t.Fatalf("got members %v, want them sorted by snowflake", ids)
+	}
+}
+
+func TestServer(t *testing.T) {
+	f, channel := testFake()
+	srv := NewServer(f)
+	defer srv.Close()
+	srv.RateLimitEvery = 2
+
+	s := srv.Session()
+	guild, err := s.Guild("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if guild.Name != "guild" {
+		t.Fatalf("got guild %q, want %q", guild.Name, "guild")
+	}
+
+	contents := walk(t, s.ChannelMessages, channel.ID)
+	if len(contents) != 250 || contents[0] != "message 249" || contents[249] != "message 0" {
+		t.Fatalf("walked %d messages from %q, want 250 from %q", len(contents), contents[0], "message 249")
+	}
+	if srv.RateLimited() == 0 {
+		t.Fatal("no requests were rate limited")
+	}
+
+	msgs, err := f.ChannelMessages(channel.ID, 1, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.AddReactionUsers(msgs[0].ID, "👍", &discordgo.User{ID: "5"}, &discordgo.User{ID: "6"})
+	users, err := s.MessageReactions(channel.ID, msgs[0].ID, "👍", 100, "", "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].ID != "6" {
+		t.Fatalf("got reaction users %v after user 5, want user 6", users)
+	}
+
+	_, err = s.Channel("4")
+	restErr, ok := err.(*discordgo.RESTError)
+	if !ok || restErr.Message == nil || restErr.Message.Code != discordgo.ErrCodeUnknownChannel {
+		t.Fatalf("got %v for an unknown channel, want an Unknown Channel error", err)
+	}
+}
@@ -0,0 +1,417 @@
+// Package discordtest provides an offline Discord API for testing archives:
+// an in-memory Fake that implements discordarchive.DiscordClient, and a
+// Server that serves the data of a Fake over HTTP to a *discordgo.Session,
+// with pagination and rate limited responses like the real API.
+package discordtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Epoch is the time of the first message created by Messages.
+var Epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Fake is an in-memory Discord API holding guilds, channels, messages and
+// members. Its methods page through messages and members like the Discord
+// API, and return copies so that callers can not change the stored data.
+// The context of a request option is honoured, so canceled requests fail.
+// It is safe for concurrent use.
+type Fake struct {
+	mu       sync.Mutex
+	guilds   map[string]*discordgo.Guild
+	channels map[string]*discordgo.Channel
+
+	// messages are the messages of each channel, sorted by ID.
+	messages map[string][]*discordgo.Message
+
+	// members are the members of each guild, sorted by user ID.
+	members map[string][]*discordgo.Member
+
+	// reactions are the users who added each reaction,
+	// keyed by message ID and emoji, sorted by user ID.
+	reactions map[string][]*discordgo.User
+}
+
+// NewFake returns an empty Fake.
+func NewFake() *Fake {
+	return &Fake{
+		guilds:    map[string]*discordgo.Guild{},
+		channels:  map[string]*discordgo.Channel{},
+		messages:  map[string][]*discordgo.Message{},
+		members:   map[string][]*discordgo.Member{},
+		reactions: map[string][]*discordgo.User{},
+	}
+}
+
+// AddGuild adds a guild, replacing the guild with the same ID.
+func (f *Fake) AddGuild(guild *discordgo.Guild) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.guilds[guild.ID] = guild
+}
+
+// AddChannel adds a channel, replacing the channel with the same ID.
+// Channels whose GuildID is set are listed by GuildChannels.
+func (f *Fake) AddChannel(channel *discordgo.Channel) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.channels[channel.ID] = channel
+}
+
+// AddMessages adds messages to their channels, replacing messages with the same ID.
+func (f *Fake) AddMessages(msgs ...*discordgo.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, msg := range msgs {
+		list := f.messages[msg.ChannelID]
+		i := sort.Search(len(list), func(i int) bool { return !less(list[i].ID, msg.ID) })
+		if i < len(list) && list[i].ID == msg.ID {
+			list[i] = msg
+			continue
+		}
+		list = append(list, nil)
+		copy(list[i+1:], list[i:])
+		list[i] = msg
+		f.messages[msg.ChannelID] = list
+	}
+}
+
+// DeleteMessage removes a message from a channel.
+func (f *Fake) DeleteMessage(channelID, messageID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := f.messages[channelID]
+	for i, msg := range list {
+		if msg.ID == messageID {
+			f.messages[channelID] = append(list[:i:i], list[i+1:]...)
+			return
+		}
+	}
+}
+
+// AddMembers adds members to a guild, replacing members with the same user ID.
+func (f *Fake) AddMembers(guildID string, members ...*discordgo.Member) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := f.members[guildID]
+	for _, m := range members {
+		i := sort.Search(len(list), func(i int) bool { return !less(list[i].User.ID, m.User.ID) })
+		if i < len(list) && list[i].User.ID == m.User.ID {
+			list[i] = m
+			continue
+		}
+		list = append(list, nil)
+		copy(list[i+1:], list[i:])
+		list[i] = m
+	}
+	f.members[guildID] = list
+}
+
+// AddReactionUsers adds the users who added a reaction to a message, replacing
+// users with the same ID. emojiID is the API name of the emoji of the reaction,
+// as returned by (*discordgo.Emoji).APIName. The reactions of the message
+// itself are left as they were added with AddMessages.
+func (f *Fake) AddReactionUsers(messageID, emojiID string, users ...*discordgo.User) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := messageID + "/" + emojiID
+	list := f.reactions[key]
+	for _, u := range users {
+		i := sort.Search(len(list), func(i int) bool { return !less(list[i].ID, u.ID) })
+		if i < len(list) && list[i].ID == u.ID {
+			list[i] = u
+			continue
+		}
+		list = append(list, nil)
+		copy(list[i+1:], list[i:])
+		list[i] = u
+	}
+	f.reactions[key] = list
+}
+
+// Guild returns a guild.
+func (f *Fake) Guild(guildID string, options ...discordgo.RequestOption) (*discordgo.Guild, error) {
+	if err := requestErr(options); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	guild, ok := f.guilds[guildID]
+	if !ok {
+		return nil, notFound(discordgo.ErrCodeUnknownGuild, "Unknown Guild")
+	}
+	g := *guild
+	return &g, nil
+}
+
+// GuildChannels returns the channels of a guild, sorted by position.
+func (f *Fake) GuildChannels(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Channel, error) {
+	if err := requestErr(options); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.guilds[guildID]; !ok {
+		return nil, notFound(discordgo.ErrCodeUnknownGuild, "Unknown Guild")
+	}
+
+	channels := []*discordgo.Channel{}
+	for _, channel := range f.channels {
+		if channel.GuildID == guildID {
+			c := *channel
+			channels = append(channels, &c)
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		if channels[i].Position != channels[j].Position {
+			return channels[i].Position < channels[j].Position
+		}
+		return less(channels[i].ID, channels[j].ID)
+	})
+	return channels, nil
+}
+
+// Channel returns a channel.
+func (f *Fake) Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	if err := requestErr(options); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	channel, ok := f.channels[channelID]
+	if !ok {
+		return nil, notFound(discordgo.ErrCodeUnknownChannel, "Unknown Channel")
+	}
+	c := *channel
+	return &c, nil
+}
+
+// ChannelMessages returns up to limit messages of a channel, newest first.
+// As with the Discord API, the messages are those before beforeID, after afterID
+// or around aroundID, or the newest messages if none of them are set.
+// A limit of 0 or less returns 50 messages, and limits above 100 return 100.
+func (f *Fake) ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string, options ...discordgo.RequestOption) ([]*discordgo.Message, error) {
+	if err := requestErr(options); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = 50
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.channels[channelID]; !ok {
+		return nil, notFound(discordgo.ErrCodeUnknownChannel, "Unknown Channel")
+	}
+
+	list := f.messages[channelID]
+	search := func(id string) int {
+		return sort.Search(len(list), func(i int) bool { return !less(list[i].ID, id) })
+	}
+
+	var start, end int
+	switch {
+	case beforeID != "":
+		end = search(beforeID)
+		start = end - limit
+	case afterID != "":
+		start = search(afterID)
+		if start < len(list) && list[start].ID == afterID {
+			start++
+		}
+		end = start + limit
+	case aroundID != "":
+		start = search(aroundID) - limit/2
+		end = start + limit
+	default:
+		end = len(list)
+		start = end - limit
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end > len(list) {
+		end = len(list)
+	}
+
+	msgs := make([]*discordgo.Message, 0, end-start)
+	for i := end - 1; i >= start; i-- {
+		m := *list[i]
+		msgs = append(msgs, &m)
+	}
+	return msgs, nil
+}
+
+// ChannelMessage returns a message of a channel.
+func (f *Fake) ChannelMessage(channelID, messageID string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	if err := requestErr(options); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.channels[channelID]; !ok {
+		return nil, notFound(discordgo.ErrCodeUnknownChannel, "Unknown Channel")
+	}
+
+	list := f.messages[channelID]
+	i := sort.Search(len(list), func(i int) bool { return !less(list[i].ID, messageID) })
+	if i == len(list) || list[i].ID != messageID {
+		return nil, notFound(discordgo.ErrCodeUnknownMessage, "Unknown Message")
+	}
+	m := *list[i]
+	return &m, nil
+}
+
+// MessageReactions returns up to limit users who added a reaction to a message
+// whose ID is after afterID, sorted by ID. beforeID is ignored, as the Discord API
+// no longer supports it. A limit of 0 or less returns 25 users, and limits above
+// 100 return 100.
+func (f *Fake) MessageReactions(channelID, messageID, emojiID string, limit int, beforeID, afterID string, options ...discordgo.RequestOption) ([]*discordgo.User, error) {
+	if err := requestErr(options); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = 25
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.channels[channelID]; !ok {
+		return nil, notFound(discordgo.ErrCodeUnknownChannel, "Unknown Channel")
+	}
+	msgs := f.messages[channelID]
+	i := sort.Search(len(msgs), func(i int) bool { return !less(msgs[i].ID, messageID) })
+	if i == len(msgs) || msgs[i].ID != messageID {
+		return nil, notFound(discordgo.ErrCodeUnknownMessage, "Unknown Message")
+	}
+
+	list := f.reactions[messageID+"/"+emojiID]
+	start := 0
+	if afterID != "" {
+		start = sort.Search(len(list), func(i int) bool { return less(afterID, list[i].ID) })
+	}
+	end := start + limit
+	if end > len(list) {
+		end = len(list)
+	}
+
+	users := make([]*discordgo.User, 0, end-start)
+	for _, u := range list[start:end] {
+		c := *u
+		users = append(users, &c)
+	}
+	return users, nil
+}
+
+// GuildMembers returns up to limit members of a guild whose user ID is after afterID,
+// sorted by user ID. A limit of 0 or less returns 1 member, and limits above 1000 return 1000.
+func (f *Fake) GuildMembers(guildID string, afterID string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error) {
+	if err := requestErr(options); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = 1
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.guilds[guildID]; !ok {
+		return nil, notFound(discordgo.ErrCodeUnknownGuild, "Unknown Guild")
+	}
+
+	list := f.members[guildID]
+	start := 0
+	if afterID != "" {
+		start = sort.Search(len(list), func(i int) bool { return less(afterID, list[i].User.ID) })
+	}
+	end := start + limit
+	if end > len(list) {
+		end = len(list)
+	}
+
+	members := make([]*discordgo.Member, 0, end-start)
+	for _, m := range list[start:end] {
+		c := *m
+		members = append(members, &c)
+	}
+	return members, nil
+}
+
+// Messages returns n messages sent to a channel by author, one minute apart
+// from Epoch onwards, with the contents "message 0" to "message n-1".
+// first is the index of the first message, so that later messages
+// of the same channel can be made with another call.
+func Messages(channel *discordgo.Channel, author *discordgo.User, first, n int) []*discordgo.Message {
+	msgs := make([]*discordgo.Message, n)
+	for i := range msgs {
+		t := Epoch.Add(time.Duration(first+i) * time.Minute)
+		msgs[i] = &discordgo.Message{
+			ID:        Snowflake(t, channel.ID),
+			ChannelID: channel.ID,
+			GuildID:   channel.GuildID,
+			Author:    author,
+			Content:   "message " + strconv.Itoa(first+i),
+			Timestamp: t,
+		}
+	}
+	return msgs
+}
+
+// Snowflake returns an ID created at t. The low bits are taken from seed,
+// so that objects created at the same time have different IDs.
+func Snowflake(t time.Time, seed string) string {
+	ms := uint64(t.UnixNano()/int64(time.Millisecond)) - 1420070400000
+	var low uint64
+	for _, c := range seed {
+		low = (low*31 + uint64(c)) & (1<<22 - 1)
+	}
+	return strconv.FormatUint(ms<<22|low, 10)
+}
+
+// less reports whether the snowflake a is older than b.
+func less(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// requestErr returns the error of the context of a request, if it is done.
+func requestErr(options []discordgo.RequestOption) error {
+	cfg := &discordgo.RequestConfig{Request: &http.Request{}}
+	for _, opt := range options {
+		opt(cfg)
+	}
+	return cfg.Request.Context().Err()
+}
+
+// notFound returns the error the Discord API responds with for an unknown object.
+func notFound(code int, message string) error {
+	msg := &discordgo.APIErrorMessage{Code: code, Message: message}
+	body, _ := json.Marshal(msg)
+	return &discordgo.RESTError{
+		Response:     &http.Response{Status: "404 Not Found", StatusCode: http.StatusNotFound},
+		ResponseBody: body,
+		Message:      msg,
+	}
+}
@@ -0,0 +1,155 @@
+package discordtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Server is an httptest server emulating the REST endpoints of the Discord API
+// that archiving uses: guilds, guild channels, guild members, channels, channel
+// messages, single messages and reaction users. It serves the data of a Fake, and can rate limit requests
+// to test that clients retry them. Other endpoints respond with 404 Not Found.
+type Server struct {
+	*httptest.Server
+
+	// Fake holds the data served.
+	Fake *Fake
+
+	// RateLimitEvery makes every nth request fail with 429 Too Many Requests,
+	// telling the client to retry after RetryAfter seconds. 0 disables rate limits.
+	RateLimitEvery int
+
+	// RetryAfter is the delay in seconds sent with rate limited responses.
+	RetryAfter float64
+
+	mu          sync.Mutex
+	requests    int
+	rateLimited int
+}
+
+// NewServer starts a server serving the data of f.
+// It must be closed once the test is finished.
+func NewServer(f *Fake) *Server {
+	s := &Server{Fake: f, RetryAfter: 0.01}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Session returns a session whose requests to the Discord API are sent to the server.
+func (s *Server) Session() *discordgo.Session {
+	session, _ := discordgo.New("Bot test")
+	target, _ := url.Parse(s.URL)
+	session.Client = &http.Client{Transport: &redirectTransport{target: target, base: s.Client().Transport}}
+	return session
+}
+
+// Requests returns the number of requests the server has received,
+// including those that were rate limited.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// RateLimited returns the number of requests that were rate limited.
+func (s *Server) RateLimited() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rateLimited
+}
+
+// limit counts a request, and reports whether it is rate limited.
+func (s *Server) limit() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.RateLimitEvery > 0 && s.requests%s.RateLimitEvery == 0 {
+		s.rateLimited++
+		return true
+	}
+	return false
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.limit() {
+		w.Header().Set("Retry-After", strconv.FormatFloat(s.RetryAfter, 'f', -1, 64))
+		writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"message":     "You are being rate limited.",
+			"retry_after": s.RetryAfter,
+			"global":      false,
+		})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v"+discordgo.APIVersion+"/")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if r.Method != http.MethodGet || len(parts) < 2 {
+		writeJSON(w, http.StatusNotFound, &discordgo.APIErrorMessage{Message: "404: Not Found"})
+		return
+	}
+
+	query := r.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+
+	var (
+		v   interface{}
+		err error
+	)
+	switch {
+	case parts[0] == "guilds" && len(parts) == 2:
+		v, err = s.Fake.Guild(parts[1])
+	case parts[0] == "guilds" && len(parts) == 3 && parts[2] == "channels":
+		v, err = s.Fake.GuildChannels(parts[1])
+	case parts[0] == "guilds" && len(parts) == 3 && parts[2] == "members":
+		v, err = s.Fake.GuildMembers(parts[1], query.Get("after"), limit)
+	case parts[0] == "channels" && len(parts) == 2:
+		v, err = s.Fake.Channel(parts[1])
+	case parts[0] == "channels" && len(parts) == 3 && parts[2] == "messages":
+		v, err = s.Fake.ChannelMessages(parts[1], limit, query.Get("before"), query.Get("after"), query.Get("around"))
+	case parts[0] == "channels" && len(parts) == 4 && parts[2] == "messages":
+		v, err = s.Fake.ChannelMessage(parts[1], parts[3])
+	case parts[0] == "channels" && len(parts) == 6 && parts[2] == "messages" && parts[4] == "reactions":
+		v, err = s.Fake.MessageReactions(parts[1], parts[3], parts[5], limit, query.Get("before"), query.Get("after"))
+	default:
+		writeJSON(w, http.StatusNotFound, &discordgo.APIErrorMessage{Message: "404: Not Found"})
+		return
+	}
+
+	if restErr, ok := err.(*discordgo.RESTError); ok {
+		writeJSON(w, restErr.Response.StatusCode, restErr.Message)
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, &discordgo.APIErrorMessage{Message: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// redirectTransport sends the requests of a session to the server instead of Discord.
+type redirectTransport struct {
+	target *url.URL
+	base   http.RoundTripper
+}
+
+// RoundTrip ...
+func (t *redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	r.Host = t.target.Host
+	return t.base.RoundTrip(r)
+}
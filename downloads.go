@@ -0,0 +1,462 @@
+package discordarchive
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// ErrClosed is returned when a download is queued after the archiver was closed.
+var ErrClosed = errors.New("error, archiver is closed")
+
+// Statuses of downloads in the downloads table.
+// Skipped downloads were fetched, but are not kept, such as embed
+// files whose type has no short extension. They are not downloaded again.
+const (
+	DownloadDone    = "done"
+	DownloadFailed  = "failed"
+	DownloadSkipped = "skipped"
+)
+
+// errSkipped is returned by the record function of a download that is not kept.
+var errSkipped = errors.New("error, download skipped")
+
+// Kinds of downloads that are not message files or guild images.
+const (
+	kindEmoji   = "emoji"
+	kindSticker = "sticker"
+	kindAvatar  = "avatar"
+)
+
+// Download is the result of downloading a file, as recorded in the downloads table.
+type Download struct {
+	// Kind is the kind of file, such as FileAttachment or GuildFileIcon.
+	Kind string
+
+	// ID is the ID of the message, emoji, sticker, user or guild the file belongs to.
+	ID        string
+	ChannelID string
+	Index     int
+	URL       string
+
+	// Status is DownloadDone, DownloadFailed or DownloadSkipped.
+	Status     string
+	Attempts   int
+	HTTPStatus int
+	Bytes      int64
+	Error      string
+	UpdatedAt  time.Time
+}
+
+// download is a file queued to be downloaded.
+type download struct {
+	// ctx stops the download from being retried once it is done.
+	ctx context.Context
+
+	// w writes to the transaction the download is recorded in.
+	// It is nil for files written to sinks other than an SQLSink.
+	w *txWriter
+
+	// kind, id, channelID and index identify the download in the downloads table.
+	// id is the ID of the message, emoji, sticker, user or guild the file belongs to.
+	kind      string
+	id        string
+	channelID string
+	index     int
+	url       string
+
+	// exists reports whether the file has already been downloaded.
+	// It may be nil.
+	exists func(tx *sql.Tx) bool
+
+	// save writes a successful response to disk and returns the number of bytes written.
+	save func(resp *http.Response) (int64, error)
+
+	// record stores the downloaded file in the database or sink.
+	// It returns errSkipped if the file is not kept.
+	record func(tx *sql.Tx) error
+}
+
+// skipped reports whether a download was recorded as skipped in tx.
+func (d *download) skipped(tx *sql.Tx) bool {
+	var n int
+	err := tx.QueryRow(
+		"SELECT count(*) FROM downloads WHERE kind=? AND id=? AND channelID=? AND idx=? AND status=?",
+		d.kind, d.id, d.channelID, d.index, DownloadSkipped,
+	).Scan(&n)
+	return err == nil && n > 0
+}
+
+// write runs fn with the transaction the download is recorded in,
+// or with a nil transaction if it is not recorded in one.
+func (d *download) write(fn func(tx *sql.Tx) error) error {
+	if d.w == nil {
+		return fn(nil)
+	}
+	return d.w.do(fn)
+}
+
+// downloadManager keeps track of queued downloads.
+type downloadManager struct {
+	wg sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newDownloadManager() *downloadManager {
+	return &downloadManager{}
+}
+
+// queue starts a download once a download token is available.
+// The transaction the download is recorded in is held until it has finished,
+// so that an SQLSink does not commit it before.
+func (a *Archiver) queue(d *download) error {
+	m := a.downloads
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrClosed
+	}
+	m.wg.Add(1)
+	m.mu.Unlock()
+
+	release := func() {}
+	if d.w != nil {
+		release = d.w.hold()
+	}
+
+	<-a.downloadTokens
+	go func() {
+		defer m.wg.Done()
+		defer release()
+		defer func() { a.downloadTokens <- struct{}{} }()
+
+		err := a.runDownload(d)
+		if err != nil {
+			a.logf("[error] error downloading %s [%s]: %s", d.kind, d.url, err.Error())
+		}
+	}()
+	return nil
+}
+
+// runDownload downloads a file and records the result.
+func (a *Archiver) runDownload(d *download) error {
+	var exists bool
+	err := d.write(func(tx *sql.Tx) error {
+		exists = d.exists != nil && d.exists(tx)
+		return nil
+	})
+	if err != nil || exists {
+		return err
+	}
+
+	httpStatus, n, attempts, err := a.fetch(d)
+
+	werr := d.write(func(tx *sql.Tx) error {
+		status := DownloadFailed
+		if err == nil {
+			err = d.record(tx)
+			switch err {
+			case nil:
+				status = DownloadDone
+			case errSkipped:
+				status, err = DownloadSkipped, nil
+			}
+		}
+		return a.recordDownload(tx, d, status, attempts, httpStatus, n, err)
+	})
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+// fetch requests a download and saves it, retrying server errors,
+// rate limits and timeouts up to DownloadRetries times, unless the context
+// of the download is done. It returns the last HTTP status received and
+// the number of attempts made.
+func (a *Archiver) fetch(d *download) (httpStatus int, n int64, attempts int, err error) {
+	for attempts = 1; ; attempts++ {
+		var (
+			retryAfter time.Duration
+			retry      bool
+			resp       *http.Response
+		)
+
+		resp, err = a.httpclient.Get(d.url)
+		if err == nil {
+			httpStatus = resp.StatusCode
+			if resp.StatusCode == http.StatusOK {
+				n, err = d.save(resp)
+				resp.Body.Close()
+				return httpStatus, n, attempts, err
+			}
+			err = fmt.Errorf("error downloading %s: %s", d.url, resp.Status)
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+			resp.Body.Close()
+		} else {
+			var netErr net.Error
+			retry = errors.As(err, &netErr) && netErr.Timeout()
+		}
+
+		if !retry || attempts > a.DownloadRetries {
+			return httpStatus, 0, attempts, err
+		}
+
+		delay := a.backoff(attempts)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		a.logf("[info] retrying download [%s] in %s: %s", d.url, delay, err.Error())
+		if !sleep(d.ctx, delay) {
+			return httpStatus, 0, attempts, err
+		}
+	}
+}
+
+// sleep waits for a duration, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// backoff returns the delay before retrying a download for the nth time.
+func (a *Archiver) backoff(n int) time.Duration {
+	d := a.DownloadBackoff << uint(n-1)
+	if d <= 0 {
+		return 0
+	}
+	// Randomize the delay between half and one and a half times its length.
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// parseRetryAfter parses the value of a Retry-After header,
+// which is either a number of seconds or a date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Duration(secs * float64(time.Second))
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// recordDownload inserts or updates the result of a download in the downloads table.
+// Nothing is recorded for downloads without a transaction.
+func (a *Archiver) recordDownload(tx *sql.Tx, d *download, status string, attempts, httpStatus int, n int64, downloadErr error) error {
+	if tx == nil {
+		return nil
+	}
+
+	var errText string
+	if downloadErr != nil {
+		errText = downloadErr.Error()
+	}
+
+	_, err := a.exec(tx,
+		"INSERT INTO downloads("+downloadColumns+") VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) "+
+			"ON CONFLICT(kind, id, channelID, idx) DO UPDATE SET "+
+			"url=excluded.url, status=excluded.status, attempts=downloads.attempts+excluded.attempts, httpStatus=excluded.httpStatus, "+
+			"bytes=excluded.bytes, error=excluded.error, updated_at=excluded.updated_at",
+		d.kind, d.id, d.channelID, d.index, d.url, status, attempts, httpStatus, n, errText, formatTimestamp(time.Now()),
+	)
+	return err
+}
+
+// Wait blocks until every queued download has finished and been recorded.
+// It must be called before committing a transaction that downloads were queued with.
+func (a *Archiver) Wait() {
+	a.downloads.wg.Wait()
+}
+
+// Close waits for queued downloads to finish and stops the download manager.
+// If the archiver's Storage implements io.Closer, it is closed as well.
+// Downloads can not be queued after the archiver is closed.
+func (a *Archiver) Close() error {
+	m := a.downloads
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.mu.Unlock()
+
+	m.wg.Wait()
+
+	if c, ok := a.Storage.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// RetryFailedDownloads queues every download recorded as failed to be
+// downloaded again, using the URLs and messages already stored in the
+// database instead of fetching them from Discord.
+// It returns the number of downloads queued, once they have finished and
+// been recorded in tx.
+func (a *Archiver) RetryFailedDownloads(tx *sql.Tx, opt *Options) (int, error) {
+	return a.RetryFailedDownloadsContext(context.Background(), tx, opt)
+}
+
+// RetryFailedDownloadsContext queues the failed downloads as RetryFailedDownloads
+// does. Once ctx is done, the queued downloads are no longer retried.
+func (a *Archiver) RetryFailedDownloadsContext(ctx context.Context, tx *sql.Tx, opt *Options) (int, error) {
+	if opt == nil {
+		opt = NewOptions()
+	}
+	err := a.InitDB(tx, opt)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query("SELECT "+downloadColumns+" FROM downloads WHERE status=?", DownloadFailed)
+	if err != nil {
+		return 0, err
+	}
+	failed, err := ScanDownloads(rows)
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// Message files are retried a message at a time, and the files of
+	// a message that were already downloaded are skipped.
+	retried := map[string]bool{}
+	sink := a.sqlSink(tx)
+	defer sink.Close()
+
+	var n int
+	for _, d := range failed {
+		queued := true
+		switch d.Kind {
+		case FileAttachment, FileEmbedImage, FileEmbedThumbnail:
+			key := d.ChannelID + "/" + d.ID + "/" + strconv.FormatBool(d.Kind == FileAttachment)
+			if retried[key] {
+				continue
+			}
+			retried[key] = true
+
+			var msg *discordgo.Message
+			err = sink.w.do(func(tx *sql.Tx) error {
+				msg, err = storedMessage(tx, d.ChannelID, d.ID)
+				return err
+			})
+			if err == nil && msg == nil {
+				err = sql.ErrNoRows
+			}
+			if err != nil {
+				break
+			}
+			if d.Kind == FileAttachment {
+				err = a.downloadAttachments(ctx, sink, msg, opt)
+			} else {
+				err = a.downloadEmbeds(ctx, sink, msg, opt)
+			}
+
+		case kindEmoji:
+			var (
+				name     string
+				animated int
+			)
+			err = sink.w.do(func(tx *sql.Tx) error {
+				return tx.QueryRow("SELECT name, animated FROM emojis WHERE emojiID=?", d.ID).Scan(&name, &animated)
+			})
+			if err != nil {
+				break
+			}
+			err = a.downloadEmoji(ctx, sink.w, &discordgo.Emoji{ID: d.ID, Name: name, Animated: animated != 0})
+
+		case kindSticker:
+			var format int
+			err = sink.w.do(func(tx *sql.Tx) error {
+				return tx.QueryRow("SELECT formatType FROM stickers WHERE stickerID=?", d.ID).Scan(&format)
+			})
+			if err != nil {
+				break
+			}
+			err = a.downloadSticker(ctx, sink.w, d.ID, discordgo.StickerFormat(format))
+
+		case kindAvatar:
+			err = a.downloadAvatarURL(ctx, sink.w, d.ID, d.URL)
+
+		default:
+			var guildJSON string
+			err = sink.w.do(func(tx *sql.Tx) error {
+				return tx.QueryRow("SELECT guildJSON FROM guilds WHERE guildID=?", d.ID).Scan(&guildJSON)
+			})
+			if err != nil {
+				break
+			}
+			guild := &discordgo.Guild{}
+			err = json.Unmarshal([]byte(guildJSON), guild)
+			if err != nil {
+				break
+			}
+			queued = false
+			for _, img := range guildImages(guild) {
+				if img.kind == d.Kind {
+					err = a.downloadGuildImage(ctx, sink.w, d.ID, img)
+					queued = true
+					break
+				}
+			}
+		}
+
+		if err == sql.ErrNoRows {
+			a.logf("[error] error retrying %s [%s]: [%s] is not archived", d.Kind, d.URL, d.ID)
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if !queued {
+			a.logf("[error] error retrying %s [%s]: guild [%s] has no such image", d.Kind, d.URL, d.ID)
+			continue
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// saveTo returns a function that saves a response to a path in the archiver's storage.
+func (a *Archiver) saveTo(pathA string) func(resp *http.Response) (int64, error) {
+	return func(resp *http.Response) (int64, error) {
+		return a.writeFile(pathA, resp.Body)
+	}
+}
+
+// writeFile writes r to a path in the archiver's storage.
+func (a *Archiver) writeFile(pathA string, r io.Reader) (int64, error) {
+	return a.storage().Put(filepath.ToSlash(pathA), r)
+}
@@ -0,0 +1,254 @@
+package discordarchive
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Necroforger/discordarchive/discordtest"
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// flakyServer responds to the first requests with the given statuses,
+// and with the file afterwards. It counts the requests it received.
+func flakyServer(t *testing.T, retryAfter string, statuses ...int) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&requests, 1))
+		if n <= len(statuses) {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		w.Write([]byte("file"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+// testDownload returns a download of url that discards what it saves.
+func testDownload(ctx context.Context, url string) *download {
+	return &download{
+		ctx: ctx,
+		url: url,
+		save: func(resp *http.Response) (int64, error) {
+			return io.Copy(io.Discard, resp.Body)
+		},
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	a := New()
+	defer a.Close()
+	a.DownloadBackoff = time.Millisecond
+
+	srv, requests := flakyServer(t, "", http.StatusInternalServerError, http.StatusBadGateway)
+	status, n, attempts, err := a.fetch(testDownload(context.Background(), srv.URL))
+	if err != nil || status != http.StatusOK || n != 4 || attempts != 3 {
+		t.Fatalf("got status %d, %d bytes and %d attempts: %v", status, n, attempts, err)
+	}
+
+	// Downloads are given up after DownloadRetries retries.
+	statuses := make([]int, a.DownloadRetries+1)
+	for i := range statuses {
+		statuses[i] = http.StatusServiceUnavailable
+	}
+	srv, _ = flakyServer(t, "", statuses...)
+	status, _, attempts, err = a.fetch(testDownload(context.Background(), srv.URL))
+	if err == nil || status != http.StatusServiceUnavailable || attempts != a.DownloadRetries+1 {
+		t.Fatalf("got status %d and %d attempts: %v", status, attempts, err)
+	}
+
+	// Client errors are not retried.
+	srv, requests = flakyServer(t, "", http.StatusNotFound)
+	_, _, attempts, err = a.fetch(testDownload(context.Background(), srv.URL))
+	if err == nil || attempts != 1 || *requests != 1 {
+		t.Fatalf("got %d attempts and %d requests for a missing file: %v", attempts, *requests, err)
+	}
+}
+
+func TestFetchRetryAfter(t *testing.T) {
+	a := New()
+	defer a.Close()
+	a.DownloadBackoff = time.Millisecond
+
+	srv, _ := flakyServer(t, "0.2", http.StatusTooManyRequests)
+	start := time.Now()
+	_, _, attempts, err := a.fetch(testDownload(context.Background(), srv.URL))
+	if err != nil || attempts != 2 {
+		t.Fatalf("got %d attempts: %v", attempts, err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("retried after %s, before the Retry-After delay", elapsed)
+	}
+}
+
+func TestFetchCanceled(t *testing.T) {
+	a := New()
+	defer a.Close()
+
+	// Waiting for the server to allow another request stops once ctx is done.
+	srv, requests := flakyServer(t, "60", http.StatusTooManyRequests)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	status, _, attempts, err := a.fetch(testDownload(ctx, srv.URL))
+	if err == nil || status != http.StatusTooManyRequests || attempts != 1 || *requests != 1 {
+		t.Fatalf("got status %d, %d attempts and %d requests: %v", status, attempts, *requests, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("canceled download waited %s to be retried", elapsed)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	a := New()
+	defer a.Close()
+	a.DownloadBackoff = 100 * time.Millisecond
+
+	for n := 1; n <= 4; n++ {
+		d := a.DownloadBackoff << uint(n-1)
+		for i := 0; i < 20; i++ {
+			if got := a.backoff(n); got < d/2 || got >= d*3/2 {
+				t.Fatalf("backoff of retry %d is %s, want between %s and %s", n, got, d/2, d*3/2)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("2"); got != 2*time.Second {
+		t.Fatalf("got %s for 2 seconds", got)
+	}
+	if got := parseRetryAfter("0.5"); got != 500*time.Millisecond {
+		t.Fatalf("got %s for half a second", got)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got < 50*time.Second || got > time.Minute {
+		t.Fatalf("got %s for a date a minute from now", got)
+	}
+	if got := parseRetryAfter("soon"); got != 0 {
+		t.Fatalf("got %s for an invalid value", got)
+	}
+}
+
+func TestRetryFailedDownloads(t *testing.T) {
+	db := openTestDB(t)
+	a := New()
+	defer a.Close()
+	a.SavePath = t.TempDir()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	err = a.InitDB(tx, nil)
+	if err == nil {
+		err = a.InsertGuild(tx, &discordgo.Guild{ID: "81384788765712384", Name: "guild"})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The banner of the guild was removed since it failed to download.
+	d := &download{kind: GuildFileBanner, id: "81384788765712384", url: "https://cdn.discordapp.com/banners/81384788765712384/a.png"}
+	if err = a.recordDownload(tx, d, DownloadFailed, 1, http.StatusInternalServerError, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := a.RetryFailedDownloads(tx, nil)
+	a.Wait()
+	if err != nil || n != 0 {
+		t.Fatalf("got %d downloads retried, want 0: %v", n, err)
+	}
+}
+
+// TestDBSinkCommitsAfterDownloads checks that a sink committing as it archives
+// records every download, even while channels are archived concurrently.
+func TestDBSinkCommitsAfterDownloads(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		w.Write([]byte("\x89PNG\r\n\x1a\n" + r.URL.Path))
+	}))
+	defer srv.Close()
+
+	f, channels := testGuild()
+	for _, channel := range channels[:2] {
+		msgs := discordtest.Messages(channel, &discordgo.User{ID: "80351110224678912"}, 1000, 20)
+		for _, msg := range msgs {
+			msg.Attachments = []*discordgo.MessageAttachment{{ID: msg.ID, URL: srv.URL + "/" + msg.ID + ".png", Filename: "image.png"}}
+		}
+		f.AddMessages(msgs...)
+	}
+
+	db := openTestDB(t)
+	a := New()
+	defer a.Close()
+	a.SavePath = t.TempDir()
+
+	sink, err := NewDBSink(a, db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := NewOptions()
+	opt.SaveAttachments = true
+	opt.ChannelConcurrency = 2
+	err = a.ArchiveGuildTo(f, sink, "81384788765712384", opt)
+	if cerr := sink.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectCount(t, db, 40, "SELECT count(*) FROM files")
+	expectCount(t, db, 40, "SELECT count(*) FROM downloads WHERE status=?", DownloadDone)
+}
+
+// TestArchiveChannelRecordsDownloads checks that the downloads of a channel
+// archived to a caller's transaction are recorded in it by the time
+// ArchiveChannel returns, so that it can be committed without waiting.
+func TestArchiveChannelRecordsDownloads(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("\x89PNG\r\n\x1a\n" + r.URL.Path))
+	}))
+	defer srv.Close()
+
+	f, channels := testGuild()
+	msgs := discordtest.Messages(channels[1], &discordgo.User{ID: "80351110224678912"}, 1000, 10)
+	for _, msg := range msgs {
+		msg.Attachments = []*discordgo.MessageAttachment{{ID: msg.ID, URL: srv.URL + "/" + msg.ID + ".png", Filename: "image.png"}}
+	}
+	f.AddMessages(msgs...)
+
+	db := openTestDB(t)
+	a := New()
+	defer a.Close()
+	a.SavePath = t.TempDir()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	opt := NewOptions()
+	opt.SaveAttachments = true
+	if err = a.ArchiveChannel(f, tx, channels[1].ID, opt); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectCount(t, db, 10, "SELECT count(*) FROM files")
+	expectCount(t, db, 10, "SELECT count(*) FROM downloads WHERE status=?", DownloadDone)
+}
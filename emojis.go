@@ -0,0 +1,242 @@
+package discordarchive
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// customEmojiRegex matches custom emojis in message content, such as <:name:id> or <a:name:id>.
+var customEmojiRegex = regexp.MustCompile(`<(a?):(\w+):(\d+)>`)
+
+// contentEmojis returns the custom emojis used in message content.
+func contentEmojis(content string) []*discordgo.Emoji {
+	var emojis []*discordgo.Emoji
+	for _, m := range customEmojiRegex.FindAllStringSubmatch(content, -1) {
+		emojis = append(emojis, &discordgo.Emoji{
+			ID:       m[3],
+			Name:     m[2],
+			Animated: m[1] == "a",
+		})
+	}
+	return emojis
+}
+
+// emojiURL returns the image url and file extension of a custom emoji.
+func emojiURL(e *discordgo.Emoji) (string, string) {
+	if e.Animated {
+		return discordgo.EndpointEmojiAnimated(e.ID), "gif"
+	}
+	return discordgo.EndpointEmoji(e.ID), "png"
+}
+
+// stickerURL returns the image url and file extension of a sticker.
+func stickerURL(stickerID string, format discordgo.StickerFormat) (string, string) {
+	ext := "png"
+	switch format {
+	case discordgo.StickerFormatTypeLottie:
+		ext = "json"
+	case discordgo.StickerFormatTypeGIF:
+		ext = "gif"
+	}
+	return discordgo.EndpointCDN + "stickers/" + stickerID + "." + ext, ext
+}
+
+// InsertEmojis inserts or updates the custom emojis of a guild.
+// The paths of previously downloaded images are kept.
+func (a *Archiver) InsertEmojis(tx *sql.Tx, guildID string, emojis []*discordgo.Emoji) error {
+	defer a.scope(tx)()
+
+	smt, err := a.prepare(tx,
+		"INSERT INTO emojis(guildID, emojiID, name, animated, emojiJSON) VALUES(?, ?, ?, ?, ?) "+
+			"ON CONFLICT(emojiID) DO UPDATE SET "+
+			"guildID=excluded.guildID, name=excluded.name, animated=excluded.animated, emojiJSON=excluded.emojiJSON",
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range emojis {
+		emojiJSON, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = smt.Exec(guildID, e.ID, e.Name, boolToInt(e.Animated), string(emojiJSON))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InsertStickers inserts or updates the stickers of a guild.
+// The paths of previously downloaded images are kept.
+func (a *Archiver) InsertStickers(tx *sql.Tx, guildID string, stickers []*discordgo.Sticker) error {
+	defer a.scope(tx)()
+
+	smt, err := a.prepare(tx,
+		"INSERT INTO stickers(guildID, stickerID, name, formatType, stickerJSON) VALUES(?, ?, ?, ?, ?) "+
+			"ON CONFLICT(stickerID) DO UPDATE SET "+
+			"guildID=excluded.guildID, name=excluded.name, formatType=excluded.formatType, stickerJSON=excluded.stickerJSON",
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, st := range stickers {
+		stickerJSON, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		_, err = smt.Exec(guildID, st.ID, st.Name, int(st.FormatType), string(stickerJSON))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InsertMessageStickers records the stickers sent with a message.
+// Stickers that are not yet known, such as standard stickers or those
+// from other guilds, are added to the stickers table without a guild.
+func (a *Archiver) InsertMessageStickers(tx *sql.Tx, msg *discordgo.Message) error {
+	if len(msg.StickerItems) == 0 {
+		return nil
+	}
+	defer a.scope(tx)()
+
+	smt, err := a.prepare(tx, upsertSQL("message_stickers",
+		"channelID, messageID, stickerID",
+		"channelID, messageID, stickerID, name, formatType",
+	))
+	if err != nil {
+		return err
+	}
+
+	for _, st := range msg.StickerItems {
+		_, err = smt.Exec(msg.ChannelID, msg.ID, st.ID, st.Name, int(st.FormatType))
+		if err != nil {
+			return err
+		}
+		_, err = a.exec(tx,
+			"INSERT INTO stickers(guildID, stickerID, name, formatType) VALUES('', ?, ?, ?) "+
+				"ON CONFLICT(stickerID) DO NOTHING",
+			st.ID, st.Name, int(st.FormatType),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasPath reports whether a downloaded file has been recorded for a row.
+func hasPath(tx *sql.Tx, query string, args ...interface{}) bool {
+	var path sql.NullString
+	err := tx.QueryRow(query, args...).Scan(&path)
+	return err == nil && path.String != ""
+}
+
+// downloadEmoji queues the image of a custom emoji to be downloaded into the emojis folder.
+func (a *Archiver) downloadEmoji(ctx context.Context, w *txWriter, e *discordgo.Emoji) error {
+	url, ext := emojiURL(e)
+	pathA := filepath.Join("emojis", e.ID+"."+ext)
+
+	return a.queue(&download{
+		ctx:  ctx,
+		w:    w,
+		kind: kindEmoji,
+		id:   e.ID,
+		url:  url,
+		exists: func(tx *sql.Tx) bool {
+			return hasPath(tx, "SELECT path FROM emojis WHERE emojiID=?", e.ID)
+		},
+		save: a.saveTo(pathA),
+		record: func(tx *sql.Tx) error {
+			_, err := tx.Exec("UPDATE emojis SET path=? WHERE emojiID=?", pathA, e.ID)
+			return err
+		},
+	})
+}
+
+// downloadSticker queues the image of a sticker to be downloaded into the stickers folder.
+func (a *Archiver) downloadSticker(ctx context.Context, w *txWriter, stickerID string, format discordgo.StickerFormat) error {
+	url, ext := stickerURL(stickerID, format)
+	pathA := filepath.Join("stickers", stickerID+"."+ext)
+
+	return a.queue(&download{
+		ctx:  ctx,
+		w:    w,
+		kind: kindSticker,
+		id:   stickerID,
+		url:  url,
+		exists: func(tx *sql.Tx) bool {
+			return hasPath(tx, "SELECT path FROM stickers WHERE stickerID=?", stickerID)
+		},
+		save: a.saveTo(pathA),
+		record: func(tx *sql.Tx) error {
+			_, err := tx.Exec("UPDATE stickers SET path=? WHERE stickerID=?", pathA, stickerID)
+			return err
+		},
+	})
+}
+
+// downloadGuildEmojis queues the emoji and sticker images of a guild to be downloaded.
+func (a *Archiver) downloadGuildEmojis(ctx context.Context, w *txWriter, guild *discordgo.Guild) error {
+	for _, e := range guild.Emojis {
+		err := a.downloadEmoji(ctx, w, e)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, st := range guild.Stickers {
+		err := a.downloadSticker(ctx, w, st.ID, st.FormatType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertContentEmojis adds the custom emojis used in a message's content
+// that are not yet known to the emojis table, without a guild.
+func (a *Archiver) insertContentEmojis(tx *sql.Tx, msg *discordgo.Message) error {
+	for _, e := range contentEmojis(msg.Content) {
+		_, err := tx.Exec(
+			"INSERT INTO emojis(guildID, emojiID, name, animated) VALUES('', ?, ?, ?) "+
+				"ON CONFLICT(emojiID) DO NOTHING",
+			e.ID, e.Name, boolToInt(e.Animated),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloadMessageEmojis queues the images of the custom emojis used
+// in a message's content and of the stickers sent with it to be downloaded.
+func (a *Archiver) downloadMessageEmojis(ctx context.Context, w *txWriter, msg *discordgo.Message) error {
+	for _, e := range contentEmojis(msg.Content) {
+		err := a.downloadEmoji(ctx, w, e)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, st := range msg.StickerItems {
+		err := a.downloadSticker(ctx, w, st.ID, st.FormatType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
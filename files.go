@@ -0,0 +1,169 @@
+package discordarchive
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of files downloaded from messages.
+const (
+	FileAttachment     = "attachment"
+	FileEmbedImage     = "embed-image"
+	FileEmbedThumbnail = "embed-thumbnail"
+)
+
+// File is a downloaded file belonging to a message.
+type File struct {
+	ChannelID string `json:"channel_id"`
+	MessageID string `json:"message_id"`
+
+	// Index is the position of the attachment or embed in the message.
+	Index int `json:"index"`
+
+	// Kind is one of FileAttachment, FileEmbedImage or FileEmbedThumbnail.
+	Kind string `json:"kind"`
+
+	// Path is the location of the file in the archiver's storage.
+	Path string `json:"path"`
+
+	// Hash is the hex encoded SHA-256 of the file's contents.
+	Hash string `json:"hash"`
+
+	Size int64  `json:"size"`
+	MIME string `json:"mime"`
+
+	// URL is the address the file was downloaded from.
+	URL string `json:"url"`
+}
+
+// BlobPath returns the path of a content-addressed file in the archiver's storage.
+func BlobPath(hash string) string {
+	return filepath.Join("blobs", hash[:2], hash)
+}
+
+// InsertMessageFile inserts or replaces a file belonging to a message.
+// A message has a single file of each kind at each index, so a file that was
+// downloaded again replaces the earlier one even if its content, and so its
+// path in blob storage, changed.
+func (a *Archiver) InsertMessageFile(tx *sql.Tx, f *File) error {
+	_, err := a.exec(tx,
+		"DELETE FROM files WHERE channelID=? AND messageID=? AND kind=? AND idx=?",
+		f.ChannelID, f.MessageID, f.Kind, f.Index,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = a.exec(tx,
+		"INSERT INTO files(channelID, messageID, path, guildID, kind, idx, hash, size, mime, url) "+
+			"VALUES(?, ?, ?, '', ?, ?, ?, ?, ?, ?)",
+		f.ChannelID, f.MessageID, f.Path, f.Kind, f.Index, f.Hash, f.Size, f.MIME, f.URL,
+	)
+	return err
+}
+
+// downloadFile queues a message file to be downloaded and written to a sink.
+// If opt.BlobStorage is set, the file is stored once per content at BlobPath.
+// Otherwise it is stored at the path returned by name for its MIME type,
+// and recorded as skipped if name returns an empty path.
+// Files already in the files table and the results of downloads are only
+// recorded for an SQLSink.
+func (a *Archiver) downloadFile(ctx context.Context, sink Sink, f *File, name func(mime string) string, opt *Options) error {
+	d := &download{
+		ctx:       ctx,
+		kind:      f.Kind,
+		id:        f.MessageID,
+		channelID: f.ChannelID,
+		index:     f.Index,
+		url:       f.URL,
+		save: func(resp *http.Response) (int64, error) {
+			return a.saveFile(resp, f, name, opt)
+		},
+		record: func(tx *sql.Tx) error {
+			if f.Path == "" {
+				return errSkipped
+			}
+			return sink.PutFile(f)
+		},
+	}
+
+	s, ok := sink.(*SQLSink)
+	if !ok {
+		return a.queue(d)
+	}
+
+	d.w = s.w
+	d.exists = func(tx *sql.Tx) bool {
+		return d.skipped(tx) || hasPath(tx,
+			"SELECT path FROM files WHERE channelID=? AND messageID=? AND kind=? AND idx=?",
+			f.ChannelID, f.MessageID, f.Kind, f.Index,
+		)
+	}
+	d.record = func(tx *sql.Tx) error {
+		if f.Path == "" {
+			return errSkipped
+		}
+		return a.InsertMessageFile(tx, f)
+	}
+	return a.queue(d)
+}
+
+// saveFile writes a downloaded message file to disk, filling in its
+// path, hash, size and MIME type.
+func (a *Archiver) saveFile(resp *http.Response, f *File, name func(mime string) string, opt *Options) (int64, error) {
+	// Infer the file type
+	body := bufio.NewReaderSize(resp.Body, 512)
+	sample, _ := body.Peek(512)
+	f.MIME = http.DetectContentType(sample)
+
+	// The path of the file depends on its hash, so it is
+	// written to a temporary file before it is stored.
+	h := sha256.New()
+	tmp, size, err := spool(body, h)
+	if err != nil {
+		return size, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	f.Size = size
+	f.Hash = hex.EncodeToString(h.Sum(nil))
+
+	if opt.BlobStorage {
+		f.Path = BlobPath(f.Hash)
+	} else {
+		f.Path = name(f.MIME)
+		if f.Path == "" {
+			return f.Size, nil
+		}
+	}
+
+	storage := a.storage()
+	pathA := filepath.ToSlash(f.Path)
+	if opt.BlobStorage {
+		exists, err := storage.Exists(pathA)
+		if err != nil || exists {
+			return f.Size, err
+		}
+	}
+
+	_, err = storage.Put(pathA, tmp)
+	return f.Size, err
+}
+
+// mimeExtension returns the file extension for a MIME type,
+// or an empty string if it is longer than four characters.
+func mimeExtension(mime string) string {
+	ext := strings.Split(strings.Split(mime, ";")[0], "/")[1]
+	if len(ext) > 4 {
+		return ""
+	}
+	return ext
+}
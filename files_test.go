@@ -0,0 +1,141 @@
+package discordarchive
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// countingStorage counts the files stored in a storage.
+type countingStorage struct {
+	Storage
+	puts int32
+}
+
+func (s *countingStorage) Put(path string, r io.Reader) (int64, error) {
+	atomic.AddInt32(&s.puts, 1)
+	return s.Storage.Put(path, r)
+}
+
+// fileServer serves files by path, counting the requests it received.
+func fileServer(t *testing.T, files map[string]string) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+// downloadMessageFiles downloads the attachments and embeds of messages
+// one message at a time, in a transaction that is then committed.
+func downloadMessageFiles(t *testing.T, a *Archiver, db *sql.DB, opt *Options, msgs ...*discordgo.Message) {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := a.sqlSink(tx)
+	defer sink.Close()
+	err = a.InitDB(tx, opt)
+	for _, msg := range msgs {
+		if err == nil {
+			err = a.downloadAttachments(context.Background(), sink, msg, opt)
+		}
+		if err == nil {
+			err = a.downloadEmbeds(context.Background(), sink, msg, opt)
+		}
+		a.Wait()
+	}
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlobStorage(t *testing.T) {
+	image := "\x89PNG\r\n\x1a\nsame image"
+	srv, requests := fileServer(t, map[string]string{"/first.png": image, "/second.png": image})
+
+	db := openTestDB(t)
+	storage := &countingStorage{Storage: NewLocalStorage(t.TempDir())}
+	a := New()
+	a.Storage = storage
+	defer a.Close()
+
+	opt := NewOptions()
+	opt.SaveAttachments = true
+	opt.BlobStorage = true
+	msgs := []*discordgo.Message{
+		{ID: "175928847299117063", ChannelID: "81384788765712385", Attachments: []*discordgo.MessageAttachment{{URL: srv.URL + "/first.png", Filename: "first.png"}}},
+		{ID: "175928847299117064", ChannelID: "81384788765712385", Attachments: []*discordgo.MessageAttachment{{URL: srv.URL + "/second.png", Filename: "second.png"}}},
+	}
+	downloadMessageFiles(t, a, db, opt, msgs...)
+
+	sum := sha256.Sum256([]byte(image))
+	hash := hex.EncodeToString(sum[:])
+	expectCount(t, db, 2, "SELECT count(*) FROM files WHERE path=? AND hash=? AND size=?", BlobPath(hash), hash, len(image))
+	if storage.puts != 1 {
+		t.Fatalf("stored the same content %d times, want once", storage.puts)
+	}
+	if got := readStored(t, storage, filepath.ToSlash(BlobPath(hash))); got != image {
+		t.Fatalf("read %q from the blob, want %q", got, image)
+	}
+
+	// Files that were already downloaded are not requested again.
+	downloadMessageFiles(t, a, db, opt, msgs...)
+	if *requests != 2 {
+		t.Fatalf("got %d requests after downloading twice, want 2", *requests)
+	}
+}
+
+func TestSkippedEmbedFile(t *testing.T) {
+	srv, requests := fileServer(t, map[string]string{"/file": "\x00\x01\x02 binary data"})
+
+	db := openTestDB(t)
+	dir := t.TempDir()
+	a := New()
+	a.SavePath = dir
+	defer a.Close()
+
+	opt := NewOptions()
+	opt.SaveEmbedImages = true
+	msg := &discordgo.Message{
+		ID:        "175928847299117063",
+		ChannelID: "81384788765712385",
+		Embeds:    []*discordgo.MessageEmbed{{Image: &discordgo.MessageEmbedImage{URL: srv.URL + "/file"}}},
+	}
+
+	// Files of type application/octet-stream have no short extension to be stored with.
+	for i := 0; i < 2; i++ {
+		downloadMessageFiles(t, a, db, opt, msg)
+	}
+	expectCount(t, db, 0, "SELECT count(*) FROM files")
+	expectCount(t, db, 1, "SELECT count(*) FROM downloads WHERE id=? AND status=?", msg.ID, DownloadSkipped)
+	if *requests != 1 {
+		t.Fatalf("skipped file was requested %d times, want once", *requests)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "embeds")); !os.IsNotExist(err) {
+		t.Fatalf("skipped file was stored: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package discordarchive
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Kinds of guild files
+const (
+	GuildFileIcon            = "icon"
+	GuildFileBanner          = "banner"
+	GuildFileSplash          = "splash"
+	GuildFileDiscoverySplash = "discovery_splash"
+)
+
+// guildImage is an image belonging to a guild.
+type guildImage struct {
+	kind string
+	hash string
+	url  string
+}
+
+// guildImages returns the images set on a guild.
+func guildImages(guild *discordgo.Guild) []guildImage {
+	images := []guildImage{}
+	if guild.Icon != "" {
+		url := discordgo.EndpointGuildIcon(guild.ID, guild.Icon)
+		if strings.HasPrefix(guild.Icon, "a_") {
+			url = discordgo.EndpointGuildIconAnimated(guild.ID, guild.Icon)
+		}
+		images = append(images, guildImage{GuildFileIcon, guild.Icon, url})
+	}
+	if guild.Banner != "" {
+		url := discordgo.EndpointGuildBanner(guild.ID, guild.Banner)
+		if strings.HasPrefix(guild.Banner, "a_") {
+			url = discordgo.EndpointGuildBannerAnimated(guild.ID, guild.Banner)
+		}
+		images = append(images, guildImage{GuildFileBanner, guild.Banner, url})
+	}
+	if guild.Splash != "" {
+		images = append(images, guildImage{GuildFileSplash, guild.Splash, discordgo.EndpointGuildSplash(guild.ID, guild.Splash)})
+	}
+	if guild.DiscoverySplash != "" {
+		images = append(images, guildImage{
+			GuildFileDiscoverySplash,
+			guild.DiscoverySplash,
+			discordgo.EndpointCDN + "discovery-splashes/" + guild.ID + "/" + guild.DiscoverySplash + ".png",
+		})
+	}
+	return images
+}
+
+// InsertGuildFile inserts a file belonging to a guild, such as its icon, into the database.
+// It replaces the previous file of the same kind.
+func (a *Archiver) InsertGuildFile(tx *sql.Tx, guildID, kind, path string) error {
+	_, err := tx.Exec("DELETE FROM files WHERE guildID=? AND kind=?", guildID, kind)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO files(channelID, messageID, path, guildID, kind) VALUES('', '', ?, ?, ?)", path, guildID, kind)
+	return err
+}
+
+// downloadGuildImage queues a guild image to be downloaded into guilds/<guildID>.
+// Images are named after their hash, so unchanged images are only downloaded once.
+func (a *Archiver) downloadGuildImage(ctx context.Context, w *txWriter, guildID string, img guildImage) error {
+	ext := filepath.Ext(img.url)
+	pathA := filepath.Join("guilds", guildID, img.kind+"-"+img.hash+ext)
+
+	return a.queue(&download{
+		ctx:  ctx,
+		w:    w,
+		kind: img.kind,
+		id:   guildID,
+		url:  img.url + "?size=1024",
+		exists: func(tx *sql.Tx) bool {
+			return hasPath(tx, "SELECT path FROM files WHERE path=?", pathA)
+		},
+		save: a.saveTo(pathA),
+		record: func(tx *sql.Tx) error {
+			return a.InsertGuildFile(tx, guildID, img.kind, pathA)
+		},
+	})
+}
+
+// downloadGuildImages queues the icon, banner, splash and discovery splash of a guild to be downloaded.
+func (a *Archiver) downloadGuildImages(ctx context.Context, w *txWriter, guild *discordgo.Guild) error {
+	for _, img := range guildImages(guild) {
+		err := a.downloadGuildImage(ctx, w, guild.ID, img)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
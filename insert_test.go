@@ -0,0 +1,200 @@
+package discordarchive
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The benchmarks below compare ways of writing pages of messages to a SQLite
+// archive, using the same synthetic dataset. Each operation is a page of 100
+// messages, the size of a page fetched from Discord. Run them with
+//
+//	go test -run NONE -bench Insert -benchmem
+
+const benchPageSize = 100
+
+// syntheticPages returns n pages of messages resembling a busy channel,
+// with mentions, attachments, embeds and reactions on some of them.
+func syntheticPages(n int) [][]*discordgo.Message {
+	author := &discordgo.User{ID: "80351110224678912", Username: "author", Avatar: "a_0123456789abcdef"}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	pages := make([][]*discordgo.Message, n)
+	id := uint64(175928847299117063)
+	for p := range pages {
+		page := make([]*discordgo.Message, benchPageSize)
+		for i := range page {
+			id++
+			msg := &discordgo.Message{
+				ID:        strconv.FormatUint(id, 10),
+				ChannelID: "81384788765712384",
+				GuildID:   "81384788765712384",
+				Author:    author,
+				Content:   strings.Repeat("lorem ipsum dolor sit amet ", 1+i%8),
+				Timestamp: start.Add(time.Duration(p*benchPageSize+i) * time.Minute),
+				Mentions:  []*discordgo.User{author},
+			}
+			if i%5 == 0 {
+				msg.Attachments = []*discordgo.MessageAttachment{{
+					ID:       msg.ID,
+					URL:      "https://cdn.discordapp.com/attachments/81384788765712384/" + msg.ID + "/image.png",
+					Filename: "image.png",
+					Size:     1 << 16,
+				}}
+			}
+			if i%7 == 0 {
+				msg.Embeds = []*discordgo.MessageEmbed{{
+					URL:         "https://example.com/" + msg.ID,
+					Title:       "embed",
+					Description: "an embedded link",
+				}}
+			}
+			if i%10 == 0 {
+				msg.Reactions = []*discordgo.MessageReactions{{
+					Count: 3,
+					Emoji: &discordgo.Emoji{Name: "👍"},
+				}}
+			}
+			page[i] = msg
+		}
+		pages[p] = page
+	}
+	return pages
+}
+
+// TestInsertOverlappingPages checks that a page overlapping messages that are
+// already archived inserts the new messages without failing.
+func TestInsertOverlappingPages(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "archive.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	a := New()
+	defer a.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err = a.InitDB(tx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := syntheticPages(2)
+	overlap := append(append([]*discordgo.Message{}, pages[0][50:]...), pages[1]...)
+	for _, page := range [][]*discordgo.Message{pages[0], overlap, overlap} {
+		if err = a.InsertMessages(tx, page); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var n int
+	if err = tx.QueryRow("SELECT count(*) FROM messages").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2*benchPageSize {
+		t.Fatalf("%d messages were archived, want %d", n, 2*benchPageSize)
+	}
+}
+
+// benchmarkInsert writes b.N pages of messages to a new archive with insert,
+// in a single transaction.
+func benchmarkInsert(b *testing.B, insert func(a *Archiver, tx *sql.Tx, page []*discordgo.Message) error) {
+	db, err := sql.Open("sqlite3", filepath.Join(b.TempDir(), "archive.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	a := New()
+	defer a.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = a.InitDB(tx, nil); err != nil {
+		b.Fatal(err)
+	}
+
+	pages := syntheticPages(b.N)
+	b.ResetTimer()
+
+	for _, page := range pages {
+		if err = insert(a, tx, page); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.StopTimer()
+	b.ReportMetric(float64(b.N*benchPageSize)/b.Elapsed().Seconds(), "msgs/s")
+}
+
+// BenchmarkInsertPrepareEach prepares a statement for every row, as messages
+// were written before statements were cached. It is the baseline.
+func BenchmarkInsertPrepareEach(b *testing.B) {
+	benchmarkInsert(b, func(a *Archiver, tx *sql.Tx, page []*discordgo.Message) error {
+		for _, msg := range page {
+			smt, err := tx.Prepare(
+				"INSERT INTO messages(" + messageColumns + ") " +
+					"VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			)
+			if err != nil {
+				return err
+			}
+			_, err = smt.Exec(messageRow(msg)...)
+			smt.Close()
+			if err != nil {
+				return err
+			}
+
+			for _, r := range msg.Reactions {
+				smt, err = tx.Prepare(upsertSQL("reactions",
+					"channelID, messageID, emojiID, emojiName",
+					"channelID, messageID, emojiID, emojiName, animated, count",
+				))
+				if err != nil {
+					return err
+				}
+				_, err = smt.Exec(msg.ChannelID, msg.ID, r.Emoji.ID, r.Emoji.Name, boolToInt(r.Emoji.Animated), r.Count)
+				smt.Close()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// BenchmarkInsertMessage writes messages one at a time with cached statements.
+func BenchmarkInsertMessage(b *testing.B) {
+	benchmarkInsert(b, func(a *Archiver, tx *sql.Tx, page []*discordgo.Message) error {
+		for _, msg := range page {
+			if err := a.InsertMessages(tx, []*discordgo.Message{msg}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// BenchmarkInsertMessages writes each page with multi-row inserts, as archiving does.
+func BenchmarkInsertMessages(b *testing.B) {
+	benchmarkInsert(b, func(a *Archiver, tx *sql.Tx, page []*discordgo.Message) error {
+		return a.InsertMessages(tx, page)
+	})
+}
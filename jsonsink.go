@@ -0,0 +1,169 @@
+package discordarchive
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Types of the records written by a JSONSink.
+const (
+	RecordGuild   = "guild"
+	RecordChannel = "channel"
+	RecordMessage = "message"
+	RecordMember  = "member"
+	RecordUser    = "user"
+	RecordFile    = "file"
+)
+
+// Record is a line written by a JSONSink.
+type Record struct {
+	// Type is one of RecordGuild, RecordChannel, RecordMessage,
+	// RecordMember, RecordUser or RecordFile.
+	Type string `json:"type"`
+
+	// Data is the guild, channel, message, member, user or File
+	// as returned by the Discord API.
+	Data interface{} `json:"data"`
+}
+
+// JSONSink writes archives as newline-delimited JSON, with a file per channel.
+// Each line is a Record. A channel, its messages and the files downloaded
+// from them are written to <channelID>.ndjson, while guilds, members and
+// users are written to guilds.ndjson, members.ndjson and users.ndjson.
+// Records are appended to existing files, so archiving a channel again
+// writes its messages again.
+// Downloaded files are stored in the archiver's storage.
+// At most jsonSinkOpenFiles files are kept open at once, so that archiving
+// a guild with many channels and threads does not run out of file descriptors.
+type JSONSink struct {
+	// Dir is the folder the files are written to.
+	Dir string
+
+	mu      sync.Mutex
+	files   map[string]*jsonFile
+	maxOpen int
+	writes  uint64
+}
+
+// jsonSinkOpenFiles is the number of files a JSONSink keeps open.
+const jsonSinkOpenFiles = 64
+
+// jsonFile is a file kept open by a JSONSink.
+type jsonFile struct {
+	*os.File
+
+	// used is the sink's write count when the file was last written to.
+	used uint64
+}
+
+// NewJSONSink returns a sink that writes to files in dir, creating it if it does not exist.
+// The sink must be closed once the archiver has been waited on.
+func NewJSONSink(dir string) (*JSONSink, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONSink{Dir: dir, files: map[string]*jsonFile{}, maxOpen: jsonSinkOpenFiles}, nil
+}
+
+// write appends a record to the file name.ndjson.
+func (s *JSONSink) write(name, recordType string, data interface{}) error {
+	line, err := json.Marshal(Record{Type: recordType, Data: data})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.files == nil {
+		return errors.New("error, json sink is closed")
+	}
+
+	f, ok := s.files[name]
+	if !ok {
+		if len(s.files) >= s.maxOpen {
+			if err = s.closeLeastUsed(); err != nil {
+				return err
+			}
+		}
+		file, err := os.OpenFile(filepath.Join(s.Dir, name+".ndjson"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		f = &jsonFile{File: file}
+		s.files[name] = f
+	}
+
+	s.writes++
+	f.used = s.writes
+	_, err = f.Write(line)
+	return err
+}
+
+// closeLeastUsed closes the file that was written to the longest time ago.
+// It is reopened for appending if it is written to again.
+func (s *JSONSink) closeLeastUsed() error {
+	var (
+		name string
+		lru  *jsonFile
+	)
+	for n, f := range s.files {
+		if lru == nil || f.used < lru.used {
+			name, lru = n, f
+		}
+	}
+	delete(s.files, name)
+	return lru.Close()
+}
+
+// PutGuild ...
+func (s *JSONSink) PutGuild(guild *discordgo.Guild) error {
+	return s.write("guilds", RecordGuild, guild)
+}
+
+// PutChannel ...
+func (s *JSONSink) PutChannel(channel *discordgo.Channel) error {
+	return s.write(channel.ID, RecordChannel, channel)
+}
+
+// PutMessage ...
+func (s *JSONSink) PutMessage(msg *discordgo.Message) error {
+	return s.write(msg.ChannelID, RecordMessage, msg)
+}
+
+// PutMember ...
+func (s *JSONSink) PutMember(m *discordgo.Member) error {
+	return s.write("members", RecordMember, m)
+}
+
+// PutUser ...
+func (s *JSONSink) PutUser(usr *discordgo.User) error {
+	return s.write("users", RecordUser, usr)
+}
+
+// PutFile ...
+func (s *JSONSink) PutFile(f *File) error {
+	return s.write(f.ChannelID, RecordFile, f)
+}
+
+// Close closes the files of the sink.
+func (s *JSONSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for _, f := range s.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	s.files = nil
+	return err
+}
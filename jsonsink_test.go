@@ -0,0 +1,82 @@
+package discordarchive
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readRecords decodes the records of a file written by a JSONSink, counted by type.
+func readRecords(t *testing.T, path string) map[string]int {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	counts := map[string]int{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var r struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		counts[r.Type]++
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return counts
+}
+
+func TestJSONSink(t *testing.T) {
+	f, channels := testGuild()
+	dir := t.TempDir()
+	sink, err := NewJSONSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every file is closed and reopened as the others are written to.
+	sink.maxOpen = 1
+
+	a := New()
+	defer a.Close()
+	opt := NewOptions()
+	opt.ChannelConcurrency = 2
+	err = a.ArchiveGuildTo(f, sink, "81384788765712384", opt)
+	if err == nil {
+		err = a.ArchiveMembersTo(f, sink, "81384788765712384", opt)
+	}
+	a.Wait()
+	if len(sink.files) > 1 {
+		t.Errorf("%d files were left open, want at most 1", len(sink.files))
+	}
+	if cerr := sink.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]int{
+		channels[0].ID: {RecordChannel: 1, RecordMessage: 250},
+		channels[1].ID: {RecordChannel: 1, RecordMessage: 30},
+		channels[2].ID: {RecordChannel: 1},
+		"guilds":       {RecordGuild: 1},
+		"members":      {RecordMember: 3},
+	}
+	for name, counts := range want {
+		got := readRecords(t, filepath.Join(dir, name+".ndjson"))
+		for recordType, n := range counts {
+			if got[recordType] != n {
+				t.Errorf("%s.ndjson has %d %s records, want %d", name, got[recordType], recordType, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package discordarchive
+
+import (
+	"context"
+	"database/sql"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// MediaFilter selects the media downloaded by DownloadMedia.
+// Empty fields match everything.
+type MediaFilter struct {
+	// GuildIDs limits downloads to messages, members and emojis of these guilds.
+	GuildIDs []string
+
+	// ChannelIDs limits downloads to messages in these channels,
+	// and to the avatars and emojis used in them.
+	ChannelIDs []string
+
+	// MIMETypes limits downloads to files of these MIME types.
+	// A type ending in a slash, such as "image/", matches every subtype.
+	// Files whose type is not known before downloading them are skipped.
+	MIMETypes []string
+
+	// MaxSize is the largest attachment, in bytes, that is downloaded.
+	// Only attachments have a known size before downloading them.
+	MaxSize int64
+}
+
+// match reports whether a file with a MIME type and size passes the filter.
+// A size of 0 is unknown.
+func (f *MediaFilter) match(mimeType string, size int64) bool {
+	if f.MaxSize > 0 && size > f.MaxSize {
+		return false
+	}
+	if len(f.MIMETypes) == 0 {
+		return true
+	}
+
+	mimeType = strings.TrimSpace(strings.Split(mimeType, ";")[0])
+	if mimeType == "" {
+		return false
+	}
+	for _, t := range f.MIMETypes {
+		if mimeType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mimeType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchURL reports whether the file at a URL passes the filter,
+// guessing its MIME type from the extension of the URL.
+func (f *MediaFilter) matchURL(rawurl string) bool {
+	var ext string
+	if u, err := url.Parse(rawurl); err == nil {
+		ext = path.Ext(u.Path)
+	}
+	return f.match(mime.TypeByExtension(ext), 0)
+}
+
+// DownloadMedia downloads the media of messages that have already been
+// archived, without fetching anything else from Discord. Attachments and
+// embed images are read from the stored messages, and avatars and emojis
+// from the users, members and emojis tables. Only the kinds of media
+// enabled in opt are downloaded, and files that were already downloaded
+// are skipped.
+func (a *Archiver) DownloadMedia(db *sql.DB, filter *MediaFilter, opt *Options) error {
+	return a.DownloadMediaContext(context.Background(), db, filter, opt)
+}
+
+// DownloadMediaContext downloads the media of archived messages until ctx is done.
+// Once ctx is done no more channels are started, the downloads already queued
+// are finished and recorded without being retried, and the error of ctx is returned.
+func (a *Archiver) DownloadMediaContext(ctx context.Context, db *sql.DB, filter *MediaFilter, opt *Options) error {
+	if filter == nil {
+		filter = &MediaFilter{}
+	}
+	if opt == nil {
+		opt = NewOptions()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	sink := a.sqlSink(tx)
+	err = a.downloadMedia(ctx, tx, sink, filter, opt)
+
+	// Downloads record their files in tx, so they must finish first.
+	sink.Close()
+
+	// Keep the files downloaded before ctx was done.
+	if err != nil && err == ctx.Err() {
+		if cerr := tx.Commit(); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// mediaPageSize is the number of messages read at a time by downloadMedia.
+const mediaPageSize = 100
+
+// downloadMedia queues the media selected by a filter to be downloaded.
+// Archived rows are read from tx, and downloads are recorded in it by sink.
+// Rows are read through the sink's writer, in pages, so that no rows are
+// left open while downloads are recorded.
+func (a *Archiver) downloadMedia(ctx context.Context, tx *sql.Tx, sink *SQLSink, filter *MediaFilter, opt *Options) error {
+	err := a.InitDB(tx, opt)
+	if err != nil {
+		return err
+	}
+
+	var channelIDs []string
+	err = sink.w.do(func(tx *sql.Tx) error {
+		channelIDs, err = mediaChannels(tx, filter)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// avatars maps the IDs of users to the URL of their avatar.
+	avatars := map[string]string{}
+	for _, channelID := range channelIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		a.logf("[info] downloading media of channel [%s]", channelID)
+
+		for afterID := ""; ; {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			var msgs []*discordgo.Message
+			err := sink.w.do(func(tx *sql.Tx) error {
+				rows, err := tx.Query(
+					"SELECT "+messageColumns+" FROM messages WHERE channelID=? AND messageID>? ORDER BY messageID LIMIT ?",
+					channelID, afterID, mediaPageSize,
+				)
+				if err != nil {
+					return err
+				}
+				defer rows.Close()
+				msgs, err = ScanMessages(rows)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if len(msgs) == 0 {
+				break
+			}
+			afterID = msgs[len(msgs)-1].ID
+
+			for _, msg := range msgs {
+				if msg.Author != nil && msg.Author.Avatar != "" {
+					avatars[msg.Author.ID] = msg.Author.AvatarURL(opt.AvatarSize)
+				}
+
+				err = a.downloadMessageMedia(ctx, sink, msg, filter, opt)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if opt.SaveAvatars {
+		err = a.downloadMediaAvatars(ctx, sink.w, avatars, filter, opt)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Emojis used in the selected channels were downloaded along with their messages.
+	if opt.SaveEmojis && len(filter.ChannelIDs) == 0 {
+		err = a.downloadMediaEmojis(ctx, sink.w, filter)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mediaChannels returns the IDs of the archived channels selected by a filter.
+func mediaChannels(tx *sql.Tx, filter *MediaFilter) ([]string, error) {
+	rows, err := tx.Query(
+		"SELECT DISTINCT messages.channelID, channels.guildID FROM messages " +
+			"LEFT JOIN channels ON channels.channelID=messages.channelID",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id, guildID sql.NullString
+		if err = rows.Scan(&id, &guildID); err != nil {
+			return nil, err
+		}
+		if len(filter.ChannelIDs) > 0 && !contains(filter.ChannelIDs, id.String) {
+			continue
+		}
+		if len(filter.GuildIDs) > 0 && !contains(filter.GuildIDs, guildID.String) {
+			continue
+		}
+		ids = append(ids, id.String)
+	}
+	return ids, rows.Err()
+}
+
+// downloadMessageMedia queues the files of a stored message that pass the filter to be downloaded.
+func (a *Archiver) downloadMessageMedia(ctx context.Context, sink *SQLSink, msg *discordgo.Message, filter *MediaFilter, opt *Options) error {
+	if opt.SaveAttachments {
+		for i, v := range msg.Attachments {
+			contentType := v.ContentType
+			if contentType == "" {
+				contentType = mime.TypeByExtension(path.Ext(v.Filename))
+			}
+			if !filter.match(contentType, int64(v.Size)) {
+				continue
+			}
+			err := a.downloadAttachment(ctx, sink, msg, i, opt)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if opt.SaveEmbedImages {
+		for i, v := range msg.Embeds {
+			if v.Image != nil && v.Image.URL != "" && filter.matchURL(v.Image.URL) {
+				err := a.downloadEmbedFile(ctx, sink, msg, i, FileEmbedImage, opt)
+				if err != nil {
+					return err
+				}
+			}
+			if v.Thumbnail != nil && v.Thumbnail.URL != "" && filter.matchURL(v.Thumbnail.URL) {
+				err := a.downloadEmbedFile(ctx, sink, msg, i, FileEmbedThumbnail, opt)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if opt.SaveEmojis {
+		err := sink.w.do(func(tx *sql.Tx) error {
+			return a.insertContentEmojis(tx, msg)
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range contentEmojis(msg.Content) {
+			if url, _ := emojiURL(e); !filter.matchURL(url) {
+				continue
+			}
+			err = a.downloadEmoji(ctx, sink.w, e)
+			if err != nil {
+				return err
+			}
+		}
+		for _, st := range msg.StickerItems {
+			if url, _ := stickerURL(st.ID, st.FormatType); !filter.matchURL(url) {
+				continue
+			}
+			err = a.downloadSticker(ctx, sink.w, st.ID, st.FormatType)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// downloadMediaAvatars queues the avatars that have not been downloaded yet.
+// avatars are those of the authors of the selected messages. Unless the filter
+// selects channels, the avatars of every archived user, or of the members of
+// the selected guilds, are downloaded as well.
+// Rows are read through w, which the downloads are recorded with.
+func (a *Archiver) downloadMediaAvatars(ctx context.Context, w *txWriter, avatars map[string]string, filter *MediaFilter, opt *Options) error {
+	if len(filter.ChannelIDs) == 0 {
+		err := w.do(func(tx *sql.Tx) error {
+			rows, err := tx.Query(
+				"SELECT users.userID, users.avatar, members.guildID FROM users " +
+					"LEFT JOIN members ON members.userID=users.userID WHERE users.avatar != ''",
+			)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var (
+					userID, url string
+					guildID     sql.NullString
+				)
+				if err = rows.Scan(&userID, &url, &guildID); err != nil {
+					return err
+				}
+				if len(filter.GuildIDs) > 0 && !contains(filter.GuildIDs, guildID.String) {
+					continue
+				}
+				// The users table holds the URL of each avatar at its default size.
+				if opt.AvatarSize != "" {
+					url += "?size=" + opt.AvatarSize
+				}
+				avatars[userID] = url
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for userID, url := range avatars {
+		var exists int
+		err := w.do(func(tx *sql.Tx) error {
+			return tx.QueryRow("SELECT COUNT(*) FROM avatarfiles WHERE userID=?", userID).Scan(&exists)
+		})
+		if err != nil {
+			return err
+		}
+		if exists != 0 || !filter.matchURL(url) {
+			continue
+		}
+
+		err = a.downloadAvatarURL(ctx, w, userID, url)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloadMediaEmojis queues the emoji and sticker images that have not been
+// downloaded yet, limited to the selected guilds.
+// Rows are read through w, which the downloads are recorded with.
+func (a *Archiver) downloadMediaEmojis(ctx context.Context, w *txWriter, filter *MediaFilter) error {
+	emojis := []*discordgo.Emoji{}
+	stickers := []*discordgo.StickerItem{}
+	err := w.do(func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT guildID, emojiID, name, animated FROM emojis WHERE path IS NULL OR path=''")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var (
+				e        = &discordgo.Emoji{}
+				guildID  sql.NullString
+				animated int
+			)
+			if err = rows.Scan(&guildID, &e.ID, &e.Name, &animated); err != nil {
+				rows.Close()
+				return err
+			}
+			e.Animated = animated != 0
+			if len(filter.GuildIDs) > 0 && !contains(filter.GuildIDs, guildID.String) {
+				continue
+			}
+			emojis = append(emojis, e)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = tx.Query("SELECT guildID, stickerID, formatType FROM stickers WHERE path IS NULL OR path=''")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				st      = &discordgo.StickerItem{}
+				guildID sql.NullString
+			)
+			if err = rows.Scan(&guildID, &st.ID, &st.FormatType); err != nil {
+				return err
+			}
+			if len(filter.GuildIDs) > 0 && !contains(filter.GuildIDs, guildID.String) {
+				continue
+			}
+			stickers = append(stickers, st)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range emojis {
+		if url, _ := emojiURL(e); !filter.matchURL(url) {
+			continue
+		}
+		err = a.downloadEmoji(ctx, w, e)
+		if err != nil {
+			return err
+		}
+	}
+	for _, st := range stickers {
+		if url, _ := stickerURL(st.ID, st.FormatType); !filter.matchURL(url) {
+			continue
+		}
+		err = a.downloadSticker(ctx, w, st.ID, st.FormatType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,454 @@
+package discordarchive
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrSchemaTooNew is returned when a database was written by a newer
+// version of the archiver than the one opening it.
+var ErrSchemaTooNew = errors.New("error, database schema is newer than this version of discordarchive supports")
+
+// migration upgrades the database schema by a single version.
+type migration struct {
+	description string
+	migrate     func(a *Archiver, tx *sql.Tx) error
+}
+
+// migrations is the ordered list of schema migrations.
+// The schema version of a database is the number of migrations applied to it.
+// Migrations must never be reordered or removed, only appended.
+// Databases created before the schema_version table existed start at version 0,
+// so every migration must also succeed on tables that already exist.
+var migrations = []migration{
+	{"create the base tables", migrateBaseTables},
+	{"create the channel_state table", migrateChannelState},
+	{"add message timestamps, type and flags", migrateMessageMetadata},
+	{"create the reactions and reaction_users tables", migrateReactions},
+	{"add message references and forwarded snapshots", migrateMessageReferences},
+	{"add thread information to channels", migrateThreads},
+	{"add forum post tags to channels", migrateForumTags},
+	{"add direct message recipients and group icons", migrateDirectMessages},
+	{"create the roles table", migrateRoles},
+	{"create the emojis, stickers and message_stickers tables", migrateEmojis},
+	{"add guild files", migrateGuildFiles},
+	{"add message revisions and deletion tombstones", migrateRevisions},
+	{"add content hashes and file metadata to files", migrateFileBlobs},
+	{"create the downloads table", migrateDownloads},
+	{"remove files replaced by later downloads", migrateReplacedFiles},
+	{"create the checkpoints table", migrateCheckpoints},
+	{"store timestamps with microseconds", migrateTimestampPrecision},
+	{"swap the channel and message ids of files stored by the first versions", migrateSwappedFileIDs},
+}
+
+// SchemaVersion is the schema version written by this version of the archiver.
+var SchemaVersion = len(migrations)
+
+// execAll executes a list of statements in order,
+// with the column types of the dialect of the database.
+func (a *Archiver) execAll(tx *sql.Tx, statements ...string) error {
+	for _, s := range statements {
+		if _, err := tx.Exec(a.dialect().Types(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DBSchemaVersion returns the schema version of the database.
+func DBSchemaVersion(tx *sql.Tx) (int, error) {
+	_, err := tx.Exec("CREATE TABLE IF NOT EXISTS schema_version(version INT)")
+	if err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	err = tx.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(version.Int64), nil
+}
+
+// Migrate upgrades the database schema to the latest version.
+// It returns the version the database had before and after migrating.
+func (a *Archiver) Migrate(tx *sql.Tx) (from, to int, err error) {
+	from, err = DBSchemaVersion(tx)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > SchemaVersion {
+		return from, from, ErrSchemaTooNew
+	}
+
+	for v := from; v < SchemaVersion; v++ {
+		m := migrations[v]
+		a.logf("[info] migrating database to schema version [%d]: %s", v+1, m.description)
+		if err = m.migrate(a, tx); err != nil {
+			return from, v, fmt.Errorf("error migrating to schema version %d: %s", v+1, err.Error())
+		}
+		if err = setSchemaVersion(tx, v+1); err != nil {
+			return from, v, err
+		}
+	}
+
+	return from, SchemaVersion, nil
+}
+
+func setSchemaVersion(tx *sql.Tx, version int) error {
+	if _, err := tx.Exec("DELETE FROM schema_version"); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO schema_version(version) VALUES(?)", version)
+	return err
+}
+
+func migrateBaseTables(a *Archiver, tx *sql.Tx) error {
+	return a.execAll(tx,
+		"CREATE TABLE IF NOT EXISTS messages("+
+			"channelID TEXT, "+
+			"messageID TEXT, "+
+			"userID TEXT, "+
+			"username TEXT, "+
+			"avatar TEXT, "+
+			"content TEXT, "+
+			"mentionsJSON TEXT, "+
+			"embedsJSON TEXT, "+
+			"attachmentsJSON TEXT, "+
+			"UNIQUE(channelID, messageID))",
+
+		"CREATE TABLE IF NOT EXISTS channels("+
+			"channelID TEXT NOT NULL UNIQUE, "+
+			"guildID TEXT, "+
+			"name TEXT, "+
+			"topic TEXT, "+
+			"type INT, "+
+			"channelJSON TEXT)",
+
+		"CREATE TABLE IF NOT EXISTS guilds("+
+			"guildID TEXT NOT NULL UNIQUE, "+
+			"name TEXT, "+
+			"guildJSON TEXT)",
+
+		"CREATE TABLE IF NOT EXISTS files("+
+			"channelID TEXT, "+
+			"messageID TEXT, "+
+			"path TEXT UNIQUE)",
+
+		"CREATE TABLE IF NOT EXISTS avatarfiles("+
+			"userID TEXT UNIQUE, "+
+			"path TEXT UNIQUE)",
+
+		"CREATE TABLE IF NOT EXISTS members("+
+			"guildID TEXT, "+
+			"userID TEXT, "+
+			"username TEXT, "+
+			"nickname TEXT, "+
+			"rolesJSON TEXT, "+
+			"UNIQUE(guildID, userID)"+
+			")",
+
+		"CREATE TABLE IF NOT EXISTS users("+
+			"userID TEXT UNIQUE, "+
+			"username TEXT, "+
+			"avatar TEXT, "+
+			"discriminator TEXT, "+
+			"verified INT"+
+			")",
+	)
+}
+
+func migrateChannelState(a *Archiver, tx *sql.Tx) error {
+	return a.execAll(tx,
+		"CREATE TABLE IF NOT EXISTS channel_state("+
+			"channelID TEXT NOT NULL UNIQUE, "+
+			"newestID TEXT, "+
+			"oldestID TEXT, "+
+			"complete INT"+
+			")",
+	)
+}
+
+func migrateMessageMetadata(a *Archiver, tx *sql.Tx) error {
+	added, err := a.addColumns(tx, "messages",
+		"timestamp TEXT",
+		"edited_timestamp TEXT",
+		"type INT",
+		"flags INT",
+		"tts INT",
+		"pinned INT",
+		"mention_everyone INT",
+	)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return nil
+	}
+
+	n, err := a.BackfillTimestamps(tx)
+	if err != nil {
+		return err
+	}
+	a.logf("[info] backfilled timestamps for [%d] messages", n)
+	return nil
+}
+
+func migrateReactions(a *Archiver, tx *sql.Tx) error {
+	return a.execAll(tx,
+		"CREATE TABLE IF NOT EXISTS reactions("+
+			"channelID TEXT, "+
+			"messageID TEXT, "+
+			"emojiID TEXT, "+
+			"emojiName TEXT, "+
+			"animated INT, "+
+			"count INT, "+
+			"UNIQUE(channelID, messageID, emojiID, emojiName)"+
+			")",
+
+		"CREATE TABLE IF NOT EXISTS reaction_users("+
+			"channelID TEXT, "+
+			"messageID TEXT, "+
+			"emojiID TEXT, "+
+			"emojiName TEXT, "+
+			"userID TEXT, "+
+			"UNIQUE(channelID, messageID, emojiID, emojiName, userID)"+
+			")",
+	)
+}
+
+func migrateMessageReferences(a *Archiver, tx *sql.Tx) error {
+	_, err := a.addColumns(tx, "messages",
+		"ref_type INT",
+		"ref_channelID TEXT",
+		"ref_messageID TEXT",
+		"ref_guildID TEXT",
+		"snapshotsJSON TEXT",
+	)
+	return err
+}
+
+func migrateThreads(a *Archiver, tx *sql.Tx) error {
+	_, err := a.addColumns(tx, "channels",
+		"parentID TEXT",
+		"ownerID TEXT",
+		"archived INT",
+		"autoArchiveDuration INT",
+	)
+	return err
+}
+
+func migrateForumTags(a *Archiver, tx *sql.Tx) error {
+	_, err := a.addColumns(tx, "channels", "tagsJSON TEXT")
+	return err
+}
+
+func migrateDirectMessages(a *Archiver, tx *sql.Tx) error {
+	_, err := a.addColumns(tx, "channels", "icon TEXT")
+	if err != nil {
+		return err
+	}
+
+	return a.execAll(tx,
+		"CREATE TABLE IF NOT EXISTS recipients("+
+			"channelID TEXT, "+
+			"userID TEXT, "+
+			"UNIQUE(channelID, userID)"+
+			")",
+	)
+}
+
+func migrateRoles(a *Archiver, tx *sql.Tx) error {
+	return a.execAll(tx,
+		"CREATE TABLE IF NOT EXISTS roles("+
+			"guildID TEXT, "+
+			"roleID TEXT, "+
+			"name TEXT, "+
+			"color INT, "+
+			"position INT, "+
+			"hoist INT, "+
+			"permissions INT, "+
+			"mentionable INT, "+
+			"managed INT, "+
+			"roleJSON TEXT, "+
+			"UNIQUE(guildID, roleID)"+
+			")",
+	)
+}
+
+func migrateEmojis(a *Archiver, tx *sql.Tx) error {
+	return a.execAll(tx,
+		"CREATE TABLE IF NOT EXISTS emojis("+
+			"guildID TEXT, "+
+			"emojiID TEXT NOT NULL UNIQUE, "+
+			"name TEXT, "+
+			"animated INT, "+
+			"path TEXT, "+
+			"emojiJSON TEXT"+
+			")",
+
+		"CREATE TABLE IF NOT EXISTS stickers("+
+			"guildID TEXT, "+
+			"stickerID TEXT NOT NULL UNIQUE, "+
+			"name TEXT, "+
+			"formatType INT, "+
+			"path TEXT, "+
+			"stickerJSON TEXT"+
+			")",
+
+		"CREATE TABLE IF NOT EXISTS message_stickers("+
+			"channelID TEXT, "+
+			"messageID TEXT, "+
+			"stickerID TEXT, "+
+			"name TEXT, "+
+			"formatType INT, "+
+			"UNIQUE(channelID, messageID, stickerID)"+
+			")",
+	)
+}
+
+func migrateGuildFiles(a *Archiver, tx *sql.Tx) error {
+	_, err := a.addColumns(tx, "files",
+		"guildID TEXT",
+		"kind TEXT",
+	)
+	return err
+}
+
+func migrateRevisions(a *Archiver, tx *sql.Tx) error {
+	_, err := a.addColumns(tx, "messages", "deleted_at TEXT")
+	if err != nil {
+		return err
+	}
+
+	return a.execAll(tx,
+		"CREATE TABLE IF NOT EXISTS message_revisions("+
+			"channelID TEXT, "+
+			"messageID TEXT, "+
+			"revised_at TEXT, "+
+			"edited_timestamp TEXT, "+
+			"content TEXT, "+
+			"embedsJSON TEXT, "+
+			"attachmentsJSON TEXT"+
+			")",
+	)
+}
+
+func migrateFileBlobs(a *Archiver, tx *sql.Tx) error {
+	// Tables written by earlier versions are SQLite tables, whose rows
+	// are copied in the order they were inserted so that fileIDs follow it.
+	order := ""
+	if a.dialect() == SQLite {
+		order = " ORDER BY rowid"
+	}
+
+	// Deduplicated files share a path, so the unique path constraint is
+	// replaced by one on the position of a file within its message.
+	return a.execAll(tx,
+		"DROP TABLE IF EXISTS files_new",
+		"CREATE TABLE files_new("+
+			"fileID INTEGER PRIMARY KEY, "+
+			"channelID TEXT, "+
+			"messageID TEXT, "+
+			"path TEXT, "+
+			"guildID TEXT, "+
+			"kind TEXT, "+
+			"idx INT NOT NULL DEFAULT 0, "+
+			"hash TEXT, "+
+			"size INT, "+
+			"mime TEXT, "+
+			"url TEXT, "+
+			"UNIQUE(channelID, messageID, kind, idx, path)"+
+			")",
+		"INSERT INTO files_new(channelID, messageID, path, guildID, kind) "+
+			"SELECT channelID, messageID, path, guildID, kind FROM files"+order,
+		"DROP TABLE files",
+		"ALTER TABLE files_new RENAME TO files",
+	)
+}
+
+func migrateDownloads(a *Archiver, tx *sql.Tx) error {
+	return a.execAll(tx,
+		"CREATE TABLE IF NOT EXISTS downloads("+
+			"kind TEXT, "+
+			"id TEXT, "+
+			"channelID TEXT, "+
+			"idx INT, "+
+			"url TEXT, "+
+			"status TEXT, "+
+			"attempts INT, "+
+			"httpStatus INT, "+
+			"bytes INT, "+
+			"error TEXT, "+
+			"updated_at TEXT, "+
+			"UNIQUE(kind, id, channelID, idx)"+
+			")",
+	)
+}
+
+// migrateReplacedFiles keeps only the latest row of each file. Files stored
+// by content hash were recorded with INSERT OR REPLACE, which only replaced
+// rows with the same path, so a file whose content changed when it was
+// downloaded again was left with a row for each version. InsertMessageFile
+// now replaces the file at the same index instead, so that readers no longer
+// need to pick the latest row. Files stored before they had a kind are all
+// at index 0, so they are kept.
+func migrateReplacedFiles(a *Archiver, tx *sql.Tx) error {
+	return a.execAll(tx,
+		"DELETE FROM files WHERE kind IS NOT NULL AND fileID IN ("+
+			"SELECT fileID FROM ("+
+			"SELECT fileID, row_number() OVER ("+
+			"PARTITION BY channelID, messageID, guildID, kind, idx ORDER BY fileID DESC"+
+			") AS n FROM files"+
+			") AS ranked WHERE n > 1"+
+			")",
+	)
+}
+
+func migrateCheckpoints(a *Archiver, tx *sql.Tx) error {
+	return a.execAll(tx,
+		"CREATE TABLE IF NOT EXISTS checkpoints("+
+			"channelID TEXT NOT NULL UNIQUE, "+
+			"lastID TEXT, "+
+			"updated_at TEXT"+
+			")",
+	)
+}
+
+// timestampColumns are the columns holding timestamps in TimestampFormat.
+var timestampColumns = []struct{ table, column string }{
+	{"messages", "timestamp"},
+	{"messages", "edited_timestamp"},
+	{"messages", "deleted_at"},
+	{"message_revisions", "revised_at"},
+	{"message_revisions", "edited_timestamp"},
+	{"downloads", "updated_at"},
+	{"checkpoints", "updated_at"},
+}
+
+// migrateTimestampPrecision pads timestamps stored with milliseconds
+// to microseconds, so that they parse and sort along with newer ones.
+func migrateTimestampPrecision(a *Archiver, tx *sql.Tx) error {
+	var statements []string
+	for _, c := range timestampColumns {
+		statements = append(statements,
+			"UPDATE "+c.table+" SET "+c.column+"=substr("+c.column+", 1, 23) || '000Z' "+
+				"WHERE length("+c.column+")=24",
+		)
+	}
+	return a.execAll(tx, statements...)
+}
+
+// migrateSwappedFileIDs swaps back the channel and message IDs of files
+// stored by the first versions, which wrote them in the wrong columns.
+// Only those files have no kind, and a file is only swapped if its IDs
+// then match a stored message.
+func migrateSwappedFileIDs(a *Archiver, tx *sql.Tx) error {
+	return a.execAll(tx,
+		"UPDATE files SET channelID=messageID, messageID=channelID "+
+			"WHERE kind IS NULL AND "+
+			"EXISTS(SELECT 1 FROM messages m WHERE m.channelID=files.messageID AND m.messageID=files.channelID)",
+	)
+}
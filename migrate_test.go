@@ -0,0 +1,234 @@
+package discordarchive
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// baselineSchema is the schema written by versions of the archiver
+// from before schema versions were recorded.
+var baselineSchema = []string{
+	"CREATE TABLE IF NOT EXISTS messages(" +
+		"channelID TEXT, " +
+		"messageID TEXT, " +
+		"userID TEXT, " +
+		"username TEXT, " +
+		"avatar TEXT, " +
+		"content TEXT, " +
+		"mentionsJSON TEXT, " +
+		"embedsJSON TEXT, " +
+		"attachmentsJSON TEXT, " +
+		"UNIQUE(channelID, messageID))",
+	"CREATE TABLE IF NOT EXISTS channels(" +
+		"channelID TEXT NOT NULL UNIQUE, " +
+		"guildID TEXT, " +
+		"name TEXT, " +
+		"topic TEXT, " +
+		"type INT, " +
+		"channelJSON TEXT)",
+	"CREATE TABLE IF NOT EXISTS guilds(" +
+		"guildID TEXT NOT NULL UNIQUE, " +
+		"name TEXT, " +
+		"guildJSON TEXT)",
+	"CREATE TABLE IF NOT EXISTS files(" +
+		"channelID TEXT, " +
+		"messageID TEXT, " +
+		"path TEXT UNIQUE)",
+	"CREATE TABLE IF NOT EXISTS avatarfiles(" +
+		"userID TEXT UNIQUE, " +
+		"path TEXT UNIQUE)",
+	"CREATE TABLE IF NOT EXISTS members(" +
+		"guildID TEXT, " +
+		"userID TEXT, " +
+		"username TEXT, " +
+		"nickname TEXT, " +
+		"rolesJSON TEXT, " +
+		"UNIQUE(guildID, userID)" +
+		")",
+	"CREATE TABLE IF NOT EXISTS users(" +
+		"userID TEXT UNIQUE, " +
+		"username TEXT, " +
+		"avatar TEXT, " +
+		"discriminator TEXT, " +
+		"verified INT" +
+		")",
+}
+
+const (
+	baselineGuild   = "81384788765712384"
+	baselineChannel = "81384788765712385"
+	baselineMessage = "175928847299117063"
+	baselineUser    = "80351110224678912"
+)
+
+// createBaseline creates a database as the baseline archiver wrote it.
+// Files were stored with their channel and message IDs swapped.
+func createBaseline(t *testing.T, db *sql.DB) {
+	statements := append(baselineSchema,
+		"INSERT INTO guilds VALUES('"+baselineGuild+"', 'guild', '{}')",
+		"INSERT INTO channels VALUES('"+baselineChannel+"', '"+baselineGuild+"', 'general', 'topic', 0, '{}')",
+		"INSERT INTO messages VALUES('"+baselineChannel+"', '"+baselineMessage+"', '"+baselineUser+"', 'author', '', 'hello', '[]', '[]', '[]')",
+		"INSERT INTO files VALUES('"+baselineMessage+"', '"+baselineChannel+"', 'attachments/"+baselineChannel+"/"+baselineMessage+"-0-a.png')",
+		"INSERT INTO files VALUES('"+baselineMessage+"', '"+baselineChannel+"', 'attachments/"+baselineChannel+"/"+baselineMessage+"-1-b.png')",
+		"INSERT INTO files VALUES('1', '2', 'attachments/2/1-0-unknown.png')",
+		"INSERT INTO avatarfiles VALUES('"+baselineUser+"', 'avatars/"+baselineUser+".png')",
+		"INSERT INTO members VALUES('"+baselineGuild+"', '"+baselineUser+"', 'author', 'nick', '[]')",
+		"INSERT INTO users VALUES('"+baselineUser+"', 'author', '', '0001', 0)",
+	)
+	for _, s := range statements {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+	}
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	db := openTestDB(t)
+	createBaseline(t, db)
+
+	a := New()
+	defer a.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, to, err := a.Migrate(tx)
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if from != 0 || to != SchemaVersion {
+		t.Fatalf("migrated from version %d to %d, want 0 to %d", from, to, SchemaVersion)
+	}
+
+	// The IDs of files belonging to archived messages are no longer swapped.
+	expectCount(t, db, 2, "SELECT count(*) FROM files WHERE channelID=? AND messageID=?", baselineChannel, baselineMessage)
+	expectCount(t, db, 1, "SELECT count(*) FROM files WHERE path=?", "attachments/"+baselineChannel+"/"+baselineMessage+"-1-b.png")
+	expectCount(t, db, 1, "SELECT count(*) FROM files WHERE channelID='1' AND messageID='2'")
+
+	msg, err := Message(db, baselineChannel, baselineMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := discordgo.SnowflakeTimestamp(baselineMessage)
+	if msg.Content != "hello" || msg.Author.ID != baselineUser || !msg.Timestamp.Equal(want) {
+		t.Fatalf("got message %q by %s at %s, want %q by %s at %s", msg.Content, msg.Author.ID, msg.Timestamp, "hello", baselineUser, want)
+	}
+	channel, err := Channel(db, baselineChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.ID != baselineChannel || channel.GuildID != baselineGuild || channel.Name != "general" {
+		t.Fatalf("got channel %s of guild %s named %q, want %s of %s named %q", channel.ID, channel.GuildID, channel.Name, baselineChannel, baselineGuild, "general")
+	}
+	expectCount(t, db, 1, "SELECT count(*) FROM guilds WHERE guildID=? AND name='guild'", baselineGuild)
+	expectCount(t, db, 1, "SELECT count(*) FROM channels WHERE channelID=? AND name='general'", baselineChannel)
+	expectCount(t, db, 1, "SELECT count(*) FROM members WHERE userID=? AND nickname='nick'", baselineUser)
+	expectCount(t, db, 1, "SELECT count(*) FROM users WHERE userID=? AND discriminator='0001'", baselineUser)
+	expectCount(t, db, 1, "SELECT count(*) FROM avatarfiles WHERE userID=?", baselineUser)
+
+	// Migrating again does nothing, and the archive can be written to.
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, to, err = a.Migrate(tx)
+	if err == nil && (from != SchemaVersion || to != SchemaVersion) {
+		t.Errorf("migrated a current database from version %d to %d", from, to)
+	}
+	if err == nil {
+		err = a.InsertMessages(tx, []*discordgo.Message{{ID: "175928847299117064", ChannelID: baselineChannel, Author: &discordgo.User{ID: baselineUser}}})
+	}
+	if err == nil {
+		err = a.InsertMessageFile(tx, &File{ChannelID: baselineChannel, MessageID: "175928847299117064", Kind: FileAttachment, Path: "blobs/ab/abc"})
+	}
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := MessageFiles(db, baselineChannel, "175928847299117064")
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got %d files of a new message: %v", len(files), err)
+	}
+}
+
+func TestMigrateReplacedFiles(t *testing.T) {
+	db := openTestDB(t)
+	statements := []string{
+		"CREATE TABLE files(fileID INTEGER PRIMARY KEY, channelID TEXT, messageID TEXT, path TEXT, guildID TEXT, kind TEXT, idx INT)",
+		// Files are ordered by their IDs rather than where they are stored.
+		"INSERT INTO files VALUES(3, '1', '2', 'a-new.png', '', 'attachment', 0)",
+		"INSERT INTO files VALUES(2, '1', '2', 'b.png', '', 'attachment', 1)",
+		"INSERT INTO files VALUES(1, '1', '2', 'a-old.png', '', 'attachment', 0)",
+		"INSERT INTO files VALUES(4, '1', '2', 'x.png', NULL, NULL, 0)",
+		"INSERT INTO files VALUES(5, '1', '2', 'y.png', NULL, NULL, 0)",
+	}
+	for _, s := range statements {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+	}
+
+	a := New()
+	defer a.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrateReplacedFiles(a, tx); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The latest row of each file is kept, along with files without a kind.
+	expectCount(t, db, 4, "SELECT count(*) FROM files")
+	expectCount(t, db, 0, "SELECT count(*) FROM files WHERE path='a-old.png'")
+	expectCount(t, db, 1, "SELECT count(*) FROM files WHERE path='a-new.png'")
+}
+
+func TestMigrateTimestampPrecision(t *testing.T) {
+	db := openTestDB(t)
+	statements := []string{
+		"CREATE TABLE messages(channelID TEXT, messageID TEXT, timestamp TEXT, edited_timestamp TEXT, deleted_at TEXT)",
+		"CREATE TABLE message_revisions(revised_at TEXT, edited_timestamp TEXT)",
+		"CREATE TABLE downloads(updated_at TEXT)",
+		"CREATE TABLE checkpoints(updated_at TEXT)",
+		"INSERT INTO messages VALUES('1', '2', '2021-06-01T14:32:46.104Z', NULL, '')",
+		"INSERT INTO messages VALUES('1', '3', '2021-06-01T14:32:46.104497Z', NULL, NULL)",
+	}
+	for _, s := range statements {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+	}
+
+	a := New()
+	defer a.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrateTimestampPrecision(a, tx); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectCount(t, db, 1, "SELECT count(*) FROM messages WHERE timestamp='2021-06-01T14:32:46.104000Z'")
+	expectCount(t, db, 1, "SELECT count(*) FROM messages WHERE timestamp='2021-06-01T14:32:46.104497Z'")
+	expectCount(t, db, 1, "SELECT count(*) FROM messages WHERE deleted_at=''")
+}
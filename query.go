@@ -2,7 +2,9 @@ package discordarchive
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -22,13 +24,13 @@ func Count(db *sql.DB, query string, args ...interface{}) (int, error) {
 func ChannelMessages(db *sql.DB, channelID string, offset, limit int) ([]*discordgo.Message, error) {
 	var rows *sql.Rows
 	if limit > 0 || offset > 0 {
-		r, err := db.Query("SELECT * FROM messages WHERE channelid=? ORDER BY messageID LIMIT ? OFFSET ?", channelID, limit, offset)
+		r, err := db.Query("SELECT "+messageColumns+" FROM messages WHERE channelID=? ORDER BY messageID LIMIT ? OFFSET ?", channelID, limit, offset)
 		if err != nil {
 			return nil, err
 		}
 		rows = r
 	} else {
-		r, err := db.Query("SELECT * FROM messages WHERE channelid=? ORDER BY messageID", channelID)
+		r, err := db.Query("SELECT "+messageColumns+" FROM messages WHERE channelID=? ORDER BY messageID", channelID)
 		if err != nil {
 			return nil, err
 		}
@@ -41,14 +43,68 @@ func ChannelMessages(db *sql.DB, channelID string, offset, limit int) ([]*discor
 	return messages, nil
 }
 
+// Message returns a single message.
+func Message(db *sql.DB, channelID, messageID string) (*discordgo.Message, error) {
+	rows, err := db.Query("SELECT "+messageColumns+" FROM messages WHERE channelID=? AND messageID=?", channelID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages, err := ScanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("message not found: " + messageID)
+	}
+
+	return messages[0], nil
+}
+
+// ReplyChain returns the chain of messages a message is replying to,
+// starting with the message it directly replies to. The chain ends at the
+// first message that is not a reply, or that has not been archived.
+func ReplyChain(db *sql.DB, channelID, messageID string) ([]*discordgo.Message, error) {
+	msg, err := Message(db, channelID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := []*discordgo.Message{}
+	seen := map[string]bool{msg.ID: true}
+	for {
+		ref := msg.MessageReference
+		if ref == nil || ref.Type != discordgo.MessageReferenceTypeDefault || seen[ref.MessageID] {
+			break
+		}
+		if ref.ChannelID == "" {
+			ref.ChannelID = msg.ChannelID
+		}
+
+		msg, err = Message(db, ref.ChannelID, ref.MessageID)
+		if err != nil {
+			break
+		}
+		seen[msg.ID] = true
+		chain = append(chain, msg)
+	}
+
+	return chain, nil
+}
+
 // Channel ...
 func Channel(db *sql.DB, channelID string) (*discordgo.Channel, error) {
-	rows, err := db.Query("SELECT * FROM channels WHERE channelID=?", channelID)
+	rows, err := db.Query("SELECT "+channelColumns+" FROM channels WHERE channelID=?", channelID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
 		return nil, errors.New("No result found")
 	}
 	channel, err := scanChannel(rows)
@@ -61,7 +117,7 @@ func Channel(db *sql.DB, channelID string) (*discordgo.Channel, error) {
 
 // Guild ...
 func Guild(db *sql.DB, guildID string) (*discordgo.Guild, error) {
-	rows, err := db.Query("SELECT * FROM guilds WHERE guildID=?", guildID)
+	rows, err := db.Query("SELECT "+guildColumns+" FROM guilds WHERE guildID=?", guildID)
 	if err != nil {
 		return nil, err
 	}
@@ -80,7 +136,7 @@ func Guild(db *sql.DB, guildID string) (*discordgo.Guild, error) {
 
 // Guilds ...
 func Guilds(db *sql.DB) ([]*discordgo.Guild, error) {
-	rows, err := db.Query("SELECT * FROM guilds")
+	rows, err := db.Query("SELECT " + guildColumns + " FROM guilds")
 	if err != nil {
 		return nil, err
 	}
@@ -95,7 +151,7 @@ func Guilds(db *sql.DB) ([]*discordgo.Guild, error) {
 
 // Channels ...
 func Channels(db *sql.DB, guildID string) ([]*discordgo.Channel, error) {
-	rows, err := db.Query("SELECT * FROM channels WHERE guildID=?", guildID)
+	rows, err := db.Query("SELECT "+channelColumns+" FROM channels WHERE guildID=?", guildID)
 	if err != nil {
 		return nil, err
 	}
@@ -107,3 +163,249 @@ func Channels(db *sql.DB, guildID string) ([]*discordgo.Channel, error) {
 
 	return channels, nil
 }
+
+// MessageReactions returns the reactions on a message.
+func MessageReactions(db *sql.DB, channelID, messageID string) ([]*discordgo.MessageReactions, error) {
+	rows, err := db.Query("SELECT emojiID, emojiName, animated, count FROM reactions WHERE channelID=? AND messageID=?", channelID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return ScanReactions(rows)
+}
+
+// ReactionUsers returns the users who added a reaction to a message.
+// Users are only stored when the message was archived with SaveReactionUsers.
+func ReactionUsers(db *sql.DB, channelID, messageID string, emoji *discordgo.Emoji) ([]*discordgo.User, error) {
+	rows, err := db.Query(
+		"SELECT r.userID, COALESCE(u.username, ''), COALESCE(u.discriminator, '') FROM reaction_users r "+
+			"LEFT JOIN users u ON u.userID=r.userID "+
+			"WHERE r.channelID=? AND r.messageID=? AND r.emojiID=? AND r.emojiName=?",
+		channelID, messageID, emoji.ID, emoji.Name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*discordgo.User{}
+	for rows.Next() {
+		u := &discordgo.User{}
+		err = rows.Scan(&u.ID, &u.Username, &u.Discriminator)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+// ForumPosts returns the archived posts of a forum or media channel.
+func ForumPosts(db *sql.DB, forumID string) ([]*discordgo.Channel, error) {
+	rows, err := db.Query("SELECT "+channelColumns+" FROM channels WHERE parentID=?", forumID)
+	if err != nil {
+		return nil, err
+	}
+
+	return ScanChannels(rows)
+}
+
+// ForumTags returns the tags applied to a forum post.
+func ForumTags(db *sql.DB, postID string) ([]discordgo.ForumTag, error) {
+	var tagsJSON sql.NullString
+	err := db.QueryRow("SELECT tagsJSON FROM channels WHERE channelID=?", postID).Scan(&tagsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []discordgo.ForumTag{}
+	if tagsJSON.String == "" {
+		return tags, nil
+	}
+	err = json.Unmarshal([]byte(tagsJSON.String), &tags)
+	return tags, err
+}
+
+// DirectMessageChannels returns the archived direct message channels.
+func DirectMessageChannels(db *sql.DB) ([]*discordgo.Channel, error) {
+	return Channels(db, "")
+}
+
+// Recipients returns the recipients of a direct message channel.
+func Recipients(db *sql.DB, channelID string) ([]*discordgo.User, error) {
+	rows, err := db.Query(
+		"SELECT r.userID, COALESCE(u.username, ''), COALESCE(u.discriminator, '') FROM recipients r "+
+			"LEFT JOIN users u ON u.userID=r.userID WHERE r.channelID=?",
+		channelID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*discordgo.User{}
+	for rows.Next() {
+		u := &discordgo.User{}
+		err = rows.Scan(&u.ID, &u.Username, &u.Discriminator)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+// Roles returns the roles of a guild, highest position first.
+func Roles(db *sql.DB, guildID string) ([]*discordgo.Role, error) {
+	rows, err := db.Query("SELECT "+roleColumns+" FROM roles WHERE guildID=? ORDER BY position DESC", guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	return ScanRoles(rows)
+}
+
+// MemberRoles returns the IDs of the roles a member had when it was archived.
+func MemberRoles(db *sql.DB, guildID, userID string) ([]string, error) {
+	var rolesJSON string
+	err := db.QueryRow("SELECT rolesJSON FROM members WHERE guildID=? AND userID=?", guildID, userID).Scan(&rolesJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := []string{}
+	err = json.Unmarshal([]byte(rolesJSON), &roles)
+	return roles, err
+}
+
+// EmojiPath returns the path of a downloaded custom emoji image,
+// relative to the archive's save path.
+func EmojiPath(db *sql.DB, emojiID string) (string, error) {
+	var path sql.NullString
+	err := db.QueryRow("SELECT path FROM emojis WHERE emojiID=?", emojiID).Scan(&path)
+	return path.String, err
+}
+
+// StickerPath returns the path of a downloaded sticker image,
+// relative to the archive's save path.
+func StickerPath(db *sql.DB, stickerID string) (string, error) {
+	var path sql.NullString
+	err := db.QueryRow("SELECT path FROM stickers WHERE stickerID=?", stickerID).Scan(&path)
+	return path.String, err
+}
+
+// MessageStickers returns the stickers sent with a message.
+func MessageStickers(db *sql.DB, channelID, messageID string) ([]*discordgo.StickerItem, error) {
+	rows, err := db.Query("SELECT stickerID, name, formatType FROM message_stickers WHERE channelID=? AND messageID=?", channelID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stickers := []*discordgo.StickerItem{}
+	for rows.Next() {
+		st := &discordgo.StickerItem{}
+		err = rows.Scan(&st.ID, &st.Name, &st.FormatType)
+		if err != nil {
+			return nil, err
+		}
+		stickers = append(stickers, st)
+	}
+
+	return stickers, rows.Err()
+}
+
+// GuildFiles returns the downloaded images of a guild, keyed by kind.
+// Paths are relative to the archive's save path.
+func GuildFiles(db *sql.DB, guildID string) (map[string]string, error) {
+	rows, err := db.Query("SELECT kind, path FROM files WHERE guildID=?", guildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := map[string]string{}
+	for rows.Next() {
+		var kind, path string
+		if err = rows.Scan(&kind, &path); err != nil {
+			return nil, err
+		}
+		files[kind] = path
+	}
+
+	return files, rows.Err()
+}
+
+// MessageRevisions returns the previous versions of an edited message, oldest first.
+func MessageRevisions(db *sql.DB, channelID, messageID string) ([]*MessageRevision, error) {
+	rows, err := db.Query(
+		"SELECT "+revisionColumns+" FROM message_revisions "+
+			"WHERE channelID=? AND messageID=? ORDER BY revised_at, COALESCE(edited_timestamp, '')",
+		channelID, messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return ScanRevisions(rows)
+}
+
+// MessageDeletedAt returns when a message was deleted.
+// The returned time is zero if the message has not been deleted.
+func MessageDeletedAt(db *sql.DB, channelID, messageID string) (time.Time, error) {
+	var deletedAt sql.NullString
+	err := db.QueryRow("SELECT deleted_at FROM messages WHERE channelID=? AND messageID=?", channelID, messageID).Scan(&deletedAt)
+	if err != nil || deletedAt.String == "" {
+		return time.Time{}, err
+	}
+	return time.Parse(TimestampFormat, deletedAt.String)
+}
+
+// ArchivedChannelIDs returns the IDs of every channel with archived messages.
+func ArchivedChannelIDs(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT DISTINCT channelID FROM messages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// MessageFiles returns the downloaded files of a message.
+func MessageFiles(db *sql.DB, channelID, messageID string) ([]*File, error) {
+	rows, err := db.Query(
+		"SELECT "+fileColumns+" FROM files "+
+			"WHERE channelID=? AND messageID=? AND kind IS NOT NULL ORDER BY kind, idx",
+		channelID, messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return ScanFiles(rows)
+}
+
+// FailedDownloads returns the downloads that have failed and not yet succeeded on a retry.
+func FailedDownloads(db *sql.DB) ([]*Download, error) {
+	rows, err := db.Query("SELECT "+downloadColumns+" FROM downloads WHERE status=? ORDER BY updated_at", DownloadFailed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return ScanDownloads(rows)
+}
@@ -0,0 +1,172 @@
+package discordarchive
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// ReconcileResult summarizes a reconciliation pass over a channel.
+type ReconcileResult struct {
+	ChannelID   string
+	ChannelName string
+
+	// Checked is the number of stored messages compared against Discord.
+	Checked int
+
+	// Deleted is the number of stored messages that no longer exist.
+	Deleted int
+
+	// Edited is the number of stored messages whose content has changed.
+	Edited int
+}
+
+// ReconcileChannel compares the archived messages of a channel against
+// the messages that still exist on Discord. Messages that no longer exist
+// are marked as deleted at the time they were found missing, and messages
+// that were edited are stored as a new revision.
+// Only the range of messages that has already been archived is checked.
+func (a *Archiver) ReconcileChannel(s DiscordClient, tx *sql.Tx, channelID string) (*ReconcileResult, error) {
+	return a.ReconcileChannelContext(context.Background(), s, tx, channelID)
+}
+
+// ReconcileChannelContext reconciles a channel until ctx is done.
+// If ctx is done before the archived range has been walked,
+// no messages are marked as deleted and the error of ctx is returned.
+func (a *Archiver) ReconcileChannelContext(ctx context.Context, s DiscordClient, tx *sql.Tx, channelID string) (*ReconcileResult, error) {
+	err := a.InitDB(tx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := a.channelState(tx, channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.reconcileMessages(ctx, s, directWriter(tx), state)
+}
+
+// reconcileMessages re-walks the archived range of a channel.
+func (a *Archiver) reconcileMessages(ctx context.Context, s DiscordClient, w *txWriter, state *ChannelState) (*ReconcileResult, error) {
+	result := &ReconcileResult{ChannelID: state.ChannelID}
+
+	var name sql.NullString
+	err := w.do(func(tx *sql.Tx) error {
+		err := tx.QueryRow("SELECT name FROM channels WHERE channelID=?", state.ChannelID).Scan(&name)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.ChannelName = name.String
+
+	if state.NewestID == "" {
+		return result, nil
+	}
+
+	// Begin just after the newest archived message so that it is included.
+	newest, err := strconv.ParseUint(state.NewestID, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	beforeID := strconv.FormatUint(newest+1, 10)
+
+	existing := map[string]bool{}
+	revisedAt := time.Now()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		msgs, err := s.ChannelMessages(state.ChannelID, 100, beforeID, "", "", discordgo.WithContext(ctx))
+		if err != nil {
+			return nil, requestErr(ctx, err)
+		}
+		if len(msgs) == 0 {
+			break
+		}
+
+		reachedOldest := false
+		err = w.do(func(tx *sql.Tx) error {
+			for _, msg := range msgs {
+				if snowflakeLess(msg.ID, state.OldestID) {
+					reachedOldest = true
+					return nil
+				}
+				existing[msg.ID] = true
+
+				stored, err := storedMessage(tx, msg.ChannelID, msg.ID)
+				if err != nil {
+					return err
+				}
+				if stored == nil || !messageChanged(stored, msg) {
+					continue
+				}
+
+				err = a.InsertRevision(tx, stored, msg, revisedAt)
+				if err != nil {
+					return err
+				}
+				result.Edited++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if reachedOldest {
+			break
+		}
+
+		beforeID = msgs[len(msgs)-1].ID
+	}
+
+	err = w.do(func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT messageID FROM messages WHERE channelID=? AND deleted_at IS NULL", state.ChannelID)
+		if err != nil {
+			return err
+		}
+		var missing []string
+		for rows.Next() {
+			var id string
+			if err = rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			if snowflakeLess(id, state.OldestID) || snowflakeLess(state.NewestID, id) {
+				continue
+			}
+			result.Checked++
+			if !existing[id] {
+				missing = append(missing, id)
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range missing {
+			err = a.MarkDeleted(tx, state.ChannelID, id, revisedAt)
+			if err != nil {
+				return err
+			}
+		}
+		result.Deleted = len(missing)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.logf("[info] reconciled [%d] messages in channel [%s]: [%d] deleted, [%d] edited", result.Checked, result.ChannelName, result.Deleted, result.Edited)
+	return result, nil
+}
@@ -0,0 +1,147 @@
+package discordarchive
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// MessageRevision is a previous version of an edited message.
+type MessageRevision struct {
+	ChannelID string
+	MessageID string
+
+	// RevisedAt is when the archiver replaced this version of the message.
+	RevisedAt time.Time
+
+	// EditedTimestamp is when this version of the message was written.
+	// It is nil for the original version of the message.
+	EditedTimestamp *time.Time
+
+	Content     string
+	Embeds      []*discordgo.MessageEmbed
+	Attachments []*discordgo.MessageAttachment
+}
+
+// InsertRevision stores the archived version of a message as a revision
+// and replaces it with the edited message.
+func (a *Archiver) InsertRevision(tx *sql.Tx, old, edited *discordgo.Message, revisedAt time.Time) error {
+	var editedTimestamp sql.NullString
+	if old.EditedTimestamp != nil {
+		editedTimestamp.String = formatTimestamp(*old.EditedTimestamp)
+		editedTimestamp.Valid = true
+	}
+
+	embedsJSON, err := json.Marshal(old.Embeds)
+	if err != nil {
+		return err
+	}
+	attachmentsJSON, err := json.Marshal(old.Attachments)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO message_revisions("+revisionColumns+") VALUES(?, ?, ?, ?, ?, ?, ?)",
+		old.ChannelID,
+		old.ID,
+		formatTimestamp(revisedAt),
+		editedTimestamp,
+		old.Content,
+		string(embedsJSON),
+		string(attachmentsJSON),
+	)
+	if err != nil {
+		return err
+	}
+
+	return a.updateMessageContent(tx, edited)
+}
+
+// updateMessageContent updates the editable fields of a stored message.
+func (a *Archiver) updateMessageContent(tx *sql.Tx, msg *discordgo.Message) error {
+	var editedTimestamp sql.NullString
+	if msg.EditedTimestamp != nil {
+		editedTimestamp.String = formatTimestamp(*msg.EditedTimestamp)
+		editedTimestamp.Valid = true
+	}
+
+	embedsJSON, err := json.Marshal(msg.Embeds)
+	if err != nil {
+		return err
+	}
+	attachmentsJSON, err := json.Marshal(msg.Attachments)
+	if err != nil {
+		return err
+	}
+	mentionsJSON, err := json.Marshal(msg.Mentions)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE messages SET content=?, embedsJSON=?, attachmentsJSON=?, mentionsJSON=?, edited_timestamp=?, flags=?, pinned=? "+
+			"WHERE channelID=? AND messageID=?",
+		msg.Content,
+		string(embedsJSON),
+		string(attachmentsJSON),
+		string(mentionsJSON),
+		editedTimestamp,
+		int(msg.Flags),
+		boolToInt(msg.Pinned),
+		msg.ChannelID,
+		msg.ID,
+	)
+	return err
+}
+
+// messageChanged reports whether an edited message differs from the archived version.
+// Attachments are compared by ID because their URLs are signed and change over time.
+// Edit times are compared to the millisecond, as messages archived before
+// timestamps were stored with microseconds only have milliseconds.
+func messageChanged(old, edited *discordgo.Message) bool {
+	if old.Content != edited.Content {
+		return true
+	}
+	if (old.EditedTimestamp == nil) != (edited.EditedTimestamp == nil) ||
+		old.EditedTimestamp != nil &&
+			!old.EditedTimestamp.Truncate(time.Millisecond).Equal(edited.EditedTimestamp.Truncate(time.Millisecond)) {
+		return true
+	}
+	if len(old.Attachments) != len(edited.Attachments) {
+		return true
+	}
+	for i := range old.Attachments {
+		if old.Attachments[i].ID != edited.Attachments[i].ID {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkDeleted marks an archived message as deleted without removing it.
+// Messages that are already marked keep their original deletion time.
+func (a *Archiver) MarkDeleted(tx *sql.Tx, channelID, messageID string, deletedAt time.Time) error {
+	_, err := tx.Exec(
+		"UPDATE messages SET deleted_at=? WHERE channelID=? AND messageID=? AND deleted_at IS NULL",
+		formatTimestamp(deletedAt), channelID, messageID,
+	)
+	return err
+}
+
+// storedMessage returns an archived message, or nil if it has not been archived.
+func storedMessage(tx *sql.Tx, channelID, messageID string) (*discordgo.Message, error) {
+	rows, err := tx.Query("SELECT "+messageColumns+" FROM messages WHERE channelID=? AND messageID=?", channelID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages, err := ScanMessages(rows)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return messages[0], nil
+}
@@ -0,0 +1,267 @@
+package discordarchive
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the hex encoded SHA-256 of an empty request body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Storage stores files in a bucket of an S3 compatible object store,
+// such as Amazon S3 or MinIO. Requests are made with path style addressing
+// and signed with AWS Signature Version 4.
+type S3Storage struct {
+	// Endpoint is the base URL of the object store,
+	// such as https://s3.us-east-1.amazonaws.com or http://localhost:9000.
+	// Defaults to https://s3.amazonaws.com
+	Endpoint string
+
+	// Bucket is the name of the bucket files are stored in.
+	Bucket string
+
+	// Prefix is prepended to the path of every file, separated by a slash.
+	Prefix string
+
+	// Region is the region of the bucket, used to sign requests.
+	// Defaults to us-east-1
+	Region string
+
+	AccessKey string
+	SecretKey string
+
+	// BaseURL is the URL files are linked to, followed by their key.
+	// Defaults to Endpoint/Bucket
+	BaseURL string
+
+	// Client is the http client used to make requests.
+	// Defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// NewS3Storage returns a storage that keeps files in a bucket.
+func NewS3Storage(endpoint, bucket, accessKey, secretKey string) *S3Storage {
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	return &S3Storage{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Bucket:    bucket,
+		Region:    "us-east-1",
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Client:    http.DefaultClient,
+	}
+}
+
+// key returns the key of the object holding a file.
+func (s *S3Storage) key(path string) string {
+	if s.Prefix == "" {
+		return path
+	}
+	return s.Prefix + "/" + path
+}
+
+// objectURL returns the URL of the object holding a file.
+func (s *S3Storage) objectURL(path string) string {
+	return s.Endpoint + "/" + s.Bucket + "/" + uriEncode(s.key(path), false)
+}
+
+// do signs and sends a request for the object holding a file.
+func (s *S3Storage) do(method, path string, body io.Reader, size int64, payloadHash string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(path), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	s.sign(req, payloadHash, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// Put uploads a file. The file is written to a temporary file first,
+// as its size and hash must be known to sign the upload.
+func (s *S3Storage) Put(path string, r io.Reader) (int64, error) {
+	h := sha256.New()
+	tmp, n, err := spool(r, h)
+	if err != nil {
+		return n, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// Detect the type of the file so that links open in the browser.
+	body := bufio.NewReaderSize(tmp, 512)
+	sample, _ := body.Peek(512)
+	header := http.Header{}
+	header.Set("Content-Type", http.DetectContentType(sample))
+
+	resp, err := s.do(http.MethodPut, path, body, n, hex.EncodeToString(h.Sum(nil)), header)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, s.responseError("storing", path, resp)
+	}
+	return n, nil
+}
+
+// Exists ...
+func (s *S3Storage) Exists(path string) (bool, error) {
+	resp, err := s.do(http.MethodHead, path, nil, 0, emptySHA256, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, s.responseError("checking", path, resp)
+}
+
+// Open ...
+func (s *S3Storage) Open(path string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, path, nil, 0, emptySHA256, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		return nil, s.responseError("opening", path, resp)
+	}
+	return resp.Body, nil
+}
+
+// URL returns the public URL of a file.
+func (s *S3Storage) URL(path string) string {
+	if s.BaseURL != "" {
+		return strings.TrimSuffix(s.BaseURL, "/") + "/" + uriEncode(s.key(path), false)
+	}
+	return s.objectURL(path)
+}
+
+func (s *S3Storage) responseError(action, path string, resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("error %s %s in bucket %s: %s %s", action, path, s.Bucket, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// sign adds an AWS Signature Version 4 authorization header to a request.
+// The host and every header already set on the request are signed.
+func (s *S3Storage) sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Canonical headers are lowercase and sorted by name.
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Canonical query parameters are sorted by name, then value.
+	query := req.URL.Query()
+	params := []string{}
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// uriEncode percent-encodes every byte of s except unreserved characters.
+// Slashes are encoded only if encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -3,10 +3,26 @@ package discordarchive
 import (
 	"database/sql"
 	"encoding/json"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
 
+// Columns read by the scan functions, in the order they are scanned.
+const (
+	messageColumns = "channelID, messageID, userID, username, avatar, content, " +
+		"mentionsJSON, embedsJSON, attachmentsJSON, timestamp, edited_timestamp, " +
+		"type, flags, tts, pinned, mention_everyone, " +
+		"ref_type, ref_channelID, ref_messageID, ref_guildID, snapshotsJSON"
+	guildColumns   = "guildID, name, guildJSON"
+	channelColumns = "channelID, guildID, name, topic, type, channelJSON, " +
+		"parentID, ownerID, archived, autoArchiveDuration, icon"
+	roleColumns     = "guildID, roleID, name, color, position, hoist, permissions, mentionable, managed, roleJSON"
+	revisionColumns = "channelID, messageID, revised_at, edited_timestamp, content, embedsJSON, attachmentsJSON"
+	fileColumns     = "channelID, messageID, idx, kind, path, hash, size, mime, url"
+	downloadColumns = "kind, id, channelID, idx, url, status, attempts, httpStatus, bytes, error, updated_at"
+)
+
 // ScanMessages scans messages from a group of roles
 func ScanMessages(rows *sql.Rows) ([]*discordgo.Message, error) {
 	messages := []*discordgo.Message{}
@@ -23,9 +39,21 @@ func ScanMessages(rows *sql.Rows) ([]*discordgo.Message, error) {
 
 func scanMessage(row *sql.Rows) (*discordgo.Message, error) {
 	var (
-		embeds      string
-		attachments string
-		mentions    string
+		embeds          string
+		attachments     string
+		mentions        string
+		timestamp       sql.NullString
+		editedTimestamp sql.NullString
+		msgType         sql.NullInt64
+		flags           sql.NullInt64
+		tts             sql.NullInt64
+		pinned          sql.NullInt64
+		mentionEveryone sql.NullInt64
+		refType         sql.NullInt64
+		refChannelID    sql.NullString
+		refMessageID    sql.NullString
+		refGuildID      sql.NullString
+		snapshots       sql.NullString
 	)
 
 	msg := &discordgo.Message{}
@@ -40,12 +68,58 @@ func scanMessage(row *sql.Rows) (*discordgo.Message, error) {
 		&msg.Content,
 		&mentions,
 		&embeds,
-		&attachments)
+		&attachments,
+		&timestamp,
+		&editedTimestamp,
+		&msgType,
+		&flags,
+		&tts,
+		&pinned,
+		&mentionEveryone,
+		&refType,
+		&refChannelID,
+		&refMessageID,
+		&refGuildID,
+		&snapshots)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if timestamp.Valid && timestamp.String != "" {
+		msg.Timestamp, err = time.Parse(TimestampFormat, timestamp.String)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if editedTimestamp.Valid && editedTimestamp.String != "" {
+		t, err := time.Parse(TimestampFormat, editedTimestamp.String)
+		if err != nil {
+			return nil, err
+		}
+		msg.EditedTimestamp = &t
+	}
+	msg.Type = discordgo.MessageType(msgType.Int64)
+	msg.Flags = discordgo.MessageFlags(flags.Int64)
+	msg.TTS = tts.Int64 != 0
+	msg.Pinned = pinned.Int64 != 0
+	msg.MentionEveryone = mentionEveryone.Int64 != 0
+
+	if refMessageID.String != "" {
+		msg.MessageReference = &discordgo.MessageReference{
+			Type:      discordgo.MessageReferenceType(refType.Int64),
+			ChannelID: refChannelID.String,
+			MessageID: refMessageID.String,
+			GuildID:   refGuildID.String,
+		}
+	}
+	if snapshots.String != "" {
+		err = json.Unmarshal([]byte(snapshots.String), &msg.MessageSnapshots)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	err = json.Unmarshal([]byte(mentions), &msg.Mentions)
 	if err != nil {
 		return nil, err
@@ -114,12 +188,17 @@ func ScanChannels(rows *sql.Rows) ([]*discordgo.Channel, error) {
 
 func scanChannel(rows *sql.Rows) (*discordgo.Channel, error) {
 	var (
-		channelID   string
-		guildID     string
-		name        string
-		topic       string
-		t           int
-		channelJSON string
+		channelID           string
+		guildID             string
+		name                string
+		topic               string
+		t                   int
+		channelJSON         string
+		parentID            sql.NullString
+		ownerID             sql.NullString
+		archived            sql.NullInt64
+		autoArchiveDuration sql.NullInt64
+		icon                sql.NullString
 	)
 
 	err := rows.Scan(
@@ -128,7 +207,15 @@ func scanChannel(rows *sql.Rows) (*discordgo.Channel, error) {
 		&name,
 		&topic,
 		&t,
-		&channelJSON)
+		&channelJSON,
+		&parentID,
+		&ownerID,
+		&archived,
+		&autoArchiveDuration,
+		&icon)
+	if err != nil {
+		return nil, err
+	}
 
 	channel := &discordgo.Channel{}
 	err = json.Unmarshal([]byte(channelJSON), channel)
@@ -136,5 +223,208 @@ func scanChannel(rows *sql.Rows) (*discordgo.Channel, error) {
 		return nil, err
 	}
 
+	// The columns are set along with the JSON, but channels migrated
+	// from the baseline schema only have them.
+	channel.ID = channelID
+	channel.GuildID = guildID
+	channel.Name = name
+	channel.Topic = topic
+	channel.Type = discordgo.ChannelType(t)
+	channel.ParentID = parentID.String
+	channel.OwnerID = ownerID.String
+	channel.Icon = icon.String
+	if channel.IsThread() {
+		if channel.ThreadMetadata == nil {
+			channel.ThreadMetadata = &discordgo.ThreadMetadata{}
+		}
+		channel.ThreadMetadata.Archived = archived.Int64 != 0
+		channel.ThreadMetadata.AutoArchiveDuration = int(autoArchiveDuration.Int64)
+	}
+
 	return channel, nil
 }
+
+// ScanReactions ...
+func ScanReactions(rows *sql.Rows) ([]*discordgo.MessageReactions, error) {
+	reactions := []*discordgo.MessageReactions{}
+	for rows.Next() {
+		var animated int
+		r := &discordgo.MessageReactions{Emoji: &discordgo.Emoji{}}
+		err := rows.Scan(&r.Emoji.ID, &r.Emoji.Name, &animated, &r.Count)
+		if err != nil {
+			return nil, err
+		}
+		r.Emoji.Animated = animated != 0
+		reactions = append(reactions, r)
+	}
+	return reactions, nil
+}
+
+// ScanRoles ...
+func ScanRoles(rows *sql.Rows) ([]*discordgo.Role, error) {
+	roles := []*discordgo.Role{}
+	for rows.Next() {
+		r, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, r)
+	}
+	return roles, nil
+}
+
+func scanRole(rows *sql.Rows) (*discordgo.Role, error) {
+	var (
+		guildID     string
+		hoist       int
+		mentionable int
+		managed     int
+		roleJSON    string
+		role        = &discordgo.Role{}
+	)
+
+	err := rows.Scan(
+		&guildID,
+		&role.ID,
+		&role.Name,
+		&role.Color,
+		&role.Position,
+		&hoist,
+		&role.Permissions,
+		&mentionable,
+		&managed,
+		&roleJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	if roleJSON != "" {
+		err = json.Unmarshal([]byte(roleJSON), role)
+		if err != nil {
+			return nil, err
+		}
+	}
+	role.Hoist = hoist != 0
+	role.Mentionable = mentionable != 0
+	role.Managed = managed != 0
+
+	return role, nil
+}
+
+// ScanRevisions ...
+func ScanRevisions(rows *sql.Rows) ([]*MessageRevision, error) {
+	revisions := []*MessageRevision{}
+	for rows.Next() {
+		var (
+			revisedAt       string
+			editedTimestamp sql.NullString
+			embeds          string
+			attachments     string
+			rev             = &MessageRevision{}
+		)
+
+		err := rows.Scan(
+			&rev.ChannelID,
+			&rev.MessageID,
+			&revisedAt,
+			&editedTimestamp,
+			&rev.Content,
+			&embeds,
+			&attachments)
+		if err != nil {
+			return nil, err
+		}
+
+		rev.RevisedAt, err = time.Parse(TimestampFormat, revisedAt)
+		if err != nil {
+			return nil, err
+		}
+		if editedTimestamp.String != "" {
+			t, err := time.Parse(TimestampFormat, editedTimestamp.String)
+			if err != nil {
+				return nil, err
+			}
+			rev.EditedTimestamp = &t
+		}
+		if err = json.Unmarshal([]byte(embeds), &rev.Embeds); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(attachments), &rev.Attachments); err != nil {
+			return nil, err
+		}
+
+		revisions = append(revisions, rev)
+	}
+	return revisions, nil
+}
+
+// ScanFiles ...
+func ScanFiles(rows *sql.Rows) ([]*File, error) {
+	files := []*File{}
+	for rows.Next() {
+		var (
+			hash, mime, url sql.NullString
+			size            sql.NullInt64
+			f               = &File{}
+		)
+
+		err := rows.Scan(
+			&f.ChannelID,
+			&f.MessageID,
+			&f.Index,
+			&f.Kind,
+			&f.Path,
+			&hash,
+			&size,
+			&mime,
+			&url)
+		if err != nil {
+			return nil, err
+		}
+		f.Hash = hash.String
+		f.Size = size.Int64
+		f.MIME = mime.String
+		f.URL = url.String
+
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// ScanDownloads ...
+func ScanDownloads(rows *sql.Rows) ([]*Download, error) {
+	downloads := []*Download{}
+	for rows.Next() {
+		var (
+			errText   sql.NullString
+			updatedAt sql.NullString
+			d         = &Download{}
+		)
+
+		err := rows.Scan(
+			&d.Kind,
+			&d.ID,
+			&d.ChannelID,
+			&d.Index,
+			&d.URL,
+			&d.Status,
+			&d.Attempts,
+			&d.HTTPStatus,
+			&d.Bytes,
+			&errText,
+			&updatedAt)
+		if err != nil {
+			return nil, err
+		}
+		d.Error = errText.String
+		if updatedAt.String != "" {
+			d.UpdatedAt, err = time.Parse(TimestampFormat, updatedAt.String)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		downloads = append(downloads, d)
+	}
+	return downloads, rows.Err()
+}
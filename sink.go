@@ -0,0 +1,278 @@
+package discordarchive
+
+import (
+	"database/sql"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Sink receives the guilds, channels, messages, members, users and files
+// of an archive as they are fetched from Discord.
+// Methods may be called from several goroutines at once when channels are
+// archived concurrently, and PutFile is called as downloads finish.
+type Sink interface {
+	PutGuild(guild *discordgo.Guild) error
+	PutChannel(channel *discordgo.Channel) error
+	PutMessage(msg *discordgo.Message) error
+	PutMember(m *discordgo.Member) error
+	PutUser(usr *discordgo.User) error
+	PutFile(f *File) error
+}
+
+// SQLSink writes archives to the tables of the archive database.
+// It is the sink used by the archiving methods that take a transaction.
+//
+// Only an SQLSink records the archived range of each channel, reaction users,
+// forum tags and downloaded emojis, avatars and guild images, so
+// Options.Update, Options.Reconcile, Options.SaveReactionUsers, Options.SaveEmojis,
+// Options.SaveAvatars and Options.SaveGuildImages have no effect with other sinks.
+// Nor are checkpoints recorded, so interrupted channels can not be resumed.
+type SQLSink struct {
+	a *Archiver
+	w *txWriter
+
+	// db is the database of a sink that owns its transactions.
+	// They are committed after every channel, and once commitEvery
+	// messages have been written if it is above 0.
+	db          *sql.DB
+	commitEvery int
+
+	// written is the number of messages written since the last commit.
+	// It is only used by functions passed to w.do.
+	written int
+
+	// release ends the scope of the statements cached for the transaction.
+	release func()
+}
+
+// NewSQLSink returns a sink that writes to tx, creating or migrating the tables of the database.
+// Files are recorded in tx as their downloads finish. Closing the sink waits for
+// the downloads recorded in tx and closes the statements it prepared on tx, so
+// it must be closed before tx is committed.
+func NewSQLSink(a *Archiver, tx *sql.Tx) (*SQLSink, error) {
+	err := a.InitDB(tx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return a.sqlSink(tx), nil
+}
+
+// NewDBSink returns a sink that writes to db in transactions of its own, creating
+// or migrating the tables of the database. A transaction is committed after every
+// channel, and once commitEvery messages have been written if commitEvery is above 0,
+// so that an error or crash only loses what was archived since the last commit.
+// Each commit includes the checkpoint that the channel being archived is resumed
+// from the next time it is archived.
+// The sink must be closed to commit its last transaction.
+func NewDBSink(a *Archiver, db *sql.DB, commitEvery int) (*SQLSink, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.InitDB(tx, nil)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	s := a.sqlSink(tx)
+	s.db = db
+	s.commitEvery = commitEvery
+	return s, nil
+}
+
+// sqlSink returns a sink that writes to a transaction whose database is already initialized.
+func (a *Archiver) sqlSink(tx *sql.Tx) *SQLSink {
+	return &SQLSink{a: a, w: directWriter(tx), release: a.scope(tx)}
+}
+
+// autocommitSink returns a sink that writes to db in a transaction of its own
+// for every write, whose database is already initialized.
+func (a *Archiver) autocommitSink(db *sql.DB) *SQLSink {
+	return &SQLSink{a: a, w: dbWriter(db), release: func() {}}
+}
+
+// commit commits the transaction of a sink that owns its transactions and begins
+// a new one, once the downloads recorded in it have finished. Unless force is set,
+// it only commits once commitEvery messages have been written since the last commit.
+// Sinks that write to a transaction of the caller are never committed.
+func (s *SQLSink) commit(force bool) error {
+	if s.db == nil {
+		return nil
+	}
+
+	due := func() bool {
+		return force || (s.commitEvery > 0 && s.written >= s.commitEvery)
+	}
+	var commit bool
+	s.w.do(func(*sql.Tx) error {
+		commit = due()
+		return nil
+	})
+	if !commit {
+		return nil
+	}
+
+	return s.w.swap(func(tx *sql.Tx) (*sql.Tx, error) {
+		// Another worker may have committed while the downloads finished.
+		if !due() {
+			return tx, nil
+		}
+
+		err := tx.Commit()
+		s.release()
+		s.release = func() {}
+		if err != nil {
+			return nil, err
+		}
+		s.written = 0
+
+		next, err := s.db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		s.release = s.a.scope(next)
+		return next, nil
+	})
+}
+
+// Close commits the last transaction of a sink created with NewDBSink, once the
+// downloads recorded in it have finished. For sinks that write to a transaction
+// of the caller, it only closes the statements the sink prepared on it.
+func (s *SQLSink) Close() error {
+	if s.db == nil {
+		// Downloads record their files in the caller's tx, so they must
+		// finish before it can be committed.
+		s.w.wait()
+		s.release()
+		return nil
+	}
+
+	return s.w.swap(func(tx *sql.Tx) (*sql.Tx, error) {
+		defer s.release()
+		return nil, tx.Commit()
+	})
+}
+
+// PutGuild inserts a guild along with its roles, emojis and stickers.
+func (s *SQLSink) PutGuild(guild *discordgo.Guild) error {
+	return s.w.do(func(tx *sql.Tx) error {
+		return s.a.insertGuildInfo(tx, guild)
+	})
+}
+
+// PutChannel inserts a channel, and the recipients of direct message channels.
+func (s *SQLSink) PutChannel(channel *discordgo.Channel) error {
+	return s.w.do(func(tx *sql.Tx) error {
+		err := s.a.InsertChannel(tx, channel)
+		if err != nil {
+			return err
+		}
+		return s.a.InsertRecipients(tx, channel)
+	})
+}
+
+// PutMessage inserts a message along with its reactions and stickers.
+func (s *SQLSink) PutMessage(msg *discordgo.Message) error {
+	return s.w.do(func(tx *sql.Tx) error {
+		s.written++
+		return s.a.InsertMessages(tx, []*discordgo.Message{msg})
+	})
+}
+
+// PutMessages inserts a page of messages with multi-row inserts.
+func (s *SQLSink) PutMessages(msgs []*discordgo.Message) error {
+	return s.w.do(func(tx *sql.Tx) error {
+		s.written += len(msgs)
+		return s.a.InsertMessages(tx, msgs)
+	})
+}
+
+// PutMember ...
+func (s *SQLSink) PutMember(m *discordgo.Member) error {
+	return s.w.do(func(tx *sql.Tx) error {
+		return s.a.InsertMember(tx, m)
+	})
+}
+
+// PutUser ...
+func (s *SQLSink) PutUser(usr *discordgo.User) error {
+	return s.w.do(func(tx *sql.Tx) error {
+		return s.a.InsertUser(tx, usr)
+	})
+}
+
+// PutFile records a message file in the files table.
+// Files downloaded by the archiver are recorded in the transaction their
+// download was queued with instead.
+func (s *SQLSink) PutFile(f *File) error {
+	return s.w.do(func(tx *sql.Tx) error {
+		return s.a.InsertMessageFile(tx, f)
+	})
+}
+
+// sinkChannelState returns the archived range of a channel.
+// Only an SQLSink records the range, so channels archived to other sinks
+// are always archived from their newest message.
+func (a *Archiver) sinkChannelState(sink Sink, channelID string) (*ChannelState, error) {
+	s, ok := sink.(*SQLSink)
+	if !ok {
+		return &ChannelState{ChannelID: channelID}, nil
+	}
+
+	var state *ChannelState
+	err := s.w.do(func(tx *sql.Tx) (err error) {
+		state, err = a.channelState(tx, channelID)
+		return err
+	})
+	return state, err
+}
+
+// updateSinkChannelState records the archived range of a channel if the sink is an SQLSink.
+func (a *Archiver) updateSinkChannelState(sink Sink, state *ChannelState) error {
+	s, ok := sink.(*SQLSink)
+	if !ok {
+		return nil
+	}
+	return s.w.do(func(tx *sql.Tx) error {
+		return a.updateChannelState(tx, state)
+	})
+}
+
+// sinkCheckpoint returns the ID of the message an interrupted walk through the
+// history of a channel is resumed before. Only an SQLSink records checkpoints.
+func (a *Archiver) sinkCheckpoint(sink Sink, channelID string) (string, error) {
+	s, ok := sink.(*SQLSink)
+	if !ok {
+		return "", nil
+	}
+
+	var lastID string
+	err := s.w.do(func(tx *sql.Tx) (err error) {
+		lastID, err = a.channelCheckpoint(tx, channelID)
+		return err
+	})
+	return lastID, err
+}
+
+// updateSinkCheckpoint records the checkpoint of a channel if the sink is an SQLSink,
+// and commits it if the sink owns its transactions and a commit is due.
+// An empty lastID removes the checkpoint once the walk is finished.
+func (a *Archiver) updateSinkCheckpoint(sink Sink, channelID, lastID string) error {
+	s, ok := sink.(*SQLSink)
+	if !ok {
+		return nil
+	}
+
+	err := s.w.do(func(tx *sql.Tx) error {
+		if lastID == "" {
+			return a.clearCheckpoint(tx, channelID)
+		}
+		return a.saveCheckpoint(tx, channelID, lastID)
+	})
+	if err != nil {
+		return err
+	}
+	return s.commit(false)
+}
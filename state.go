@@ -0,0 +1,104 @@
+package discordarchive
+
+import (
+	"database/sql"
+	"time"
+)
+
+// ChannelState stores the archived range of a channel's messages.
+type ChannelState struct {
+	ChannelID string
+
+	// NewestID is the ID of the newest archived message.
+	NewestID string
+
+	// OldestID is the ID of the oldest archived message.
+	OldestID string
+
+	// Complete is set once the beginning of the channel has been reached.
+	Complete bool
+}
+
+// include widens the archived range to contain the given message id.
+func (st *ChannelState) include(messageID string) {
+	if st.NewestID == "" || snowflakeLess(st.NewestID, messageID) {
+		st.NewestID = messageID
+	}
+	if st.OldestID == "" || snowflakeLess(messageID, st.OldestID) {
+		st.OldestID = messageID
+	}
+}
+
+// channelState retrieves the archived range of a channel.
+// If no state has been recorded, the range is taken from the messages table
+// so that databases created before the state table existed can be updated.
+func (a *Archiver) channelState(tx *sql.Tx, channelID string) (*ChannelState, error) {
+	st := &ChannelState{ChannelID: channelID}
+
+	var complete int
+	err := tx.QueryRow(
+		"SELECT newestID, oldestID, complete FROM channel_state WHERE channelID=?", channelID,
+	).Scan(&st.NewestID, &st.OldestID, &complete)
+	if err == nil {
+		st.Complete = complete != 0
+		return st, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	err = tx.QueryRow(
+		"SELECT messageID FROM messages WHERE channelID=? ORDER BY length(messageID) DESC, messageID DESC LIMIT 1", channelID,
+	).Scan(&st.NewestID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	err = tx.QueryRow(
+		"SELECT messageID FROM messages WHERE channelID=? ORDER BY length(messageID), messageID LIMIT 1", channelID,
+	).Scan(&st.OldestID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// updateChannelState inserts or updates the archived range of a channel.
+func (a *Archiver) updateChannelState(tx *sql.Tx, st *ChannelState) error {
+	var complete int
+	if st.Complete {
+		complete = 1
+	}
+
+	_, err := a.exec(tx, upsertSQL("channel_state", "channelID", "channelID, newestID, oldestID, complete"),
+		st.ChannelID, st.NewestID, st.OldestID, complete)
+	return err
+}
+
+// channelCheckpoint returns the ID of the message an interrupted walk through
+// the history of a channel is resumed before, or an empty string if the last
+// walk through the channel was finished.
+func (a *Archiver) channelCheckpoint(tx *sql.Tx, channelID string) (string, error) {
+	var lastID string
+	err := tx.QueryRow("SELECT lastID FROM checkpoints WHERE channelID=?", channelID).Scan(&lastID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return lastID, err
+}
+
+// saveCheckpoint records the ID of the oldest message fetched by a walk through the history of a channel.
+func (a *Archiver) saveCheckpoint(tx *sql.Tx, channelID, lastID string) error {
+	_, err := a.exec(tx,
+		upsertSQL("checkpoints", "channelID", "channelID, lastID, updated_at"),
+		channelID, lastID, formatTimestamp(time.Now()),
+	)
+	return err
+}
+
+// clearCheckpoint removes the checkpoint of a channel once a walk through its history is finished.
+func (a *Archiver) clearCheckpoint(tx *sql.Tx, channelID string) error {
+	_, err := a.exec(tx, "DELETE FROM checkpoints WHERE channelID=?", channelID)
+	return err
+}
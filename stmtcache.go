@@ -0,0 +1,140 @@
+package discordarchive
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+)
+
+// maxBatchParams is the largest number of parameters bound in a multi-row insert.
+// It is the lowest limit of the supported databases, that of SQLite before 3.32.
+const maxBatchParams = 999
+
+// stmtCache keeps the statements prepared on transactions that are in scope,
+// so that rows written to the same transaction reuse them instead of preparing
+// a statement for every row. A transaction is put in scope by the SQLSink that
+// writes to it, or for the length of a call by the exported methods that take
+// a transaction, and its statements are closed and removed once the scope ends.
+type stmtCache struct {
+	mu  sync.Mutex
+	txs map[*sql.Tx]map[string]*sql.Stmt
+}
+
+func newStmtCache() *stmtCache {
+	return &stmtCache{txs: map[*sql.Tx]map[string]*sql.Stmt{}}
+}
+
+// scope caches the statements prepared on tx until the returned function is
+// called. If tx is already in scope, the returned function does nothing, so
+// that the statements are kept until the outermost scope ends. The returned
+// function may be called more than once.
+func (c *stmtCache) scope(tx *sql.Tx) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.txs[tx]; ok {
+		return func() {}
+	}
+	c.txs[tx] = map[string]*sql.Stmt{}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			for _, smt := range c.txs[tx] {
+				smt.Close()
+			}
+			delete(c.txs, tx)
+		})
+	}
+}
+
+// prepare returns a statement for query prepared on tx, reusing the one
+// prepared by an earlier call with the same transaction and query.
+// If tx is not in scope the statement is not cached, and it is only
+// closed once tx ends.
+func (c *stmtCache) prepare(tx *sql.Tx, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stmts, ok := c.txs[tx]
+	if !ok {
+		return tx.Prepare(query)
+	}
+
+	if smt, ok := stmts[query]; ok {
+		return smt, nil
+	}
+	smt, err := tx.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	stmts[query] = smt
+	return smt, nil
+}
+
+// inScope reports whether the statements prepared on tx are cached.
+func (c *stmtCache) inScope(tx *sql.Tx) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.txs[tx]
+	return ok
+}
+
+// scope caches the statements prepared on tx until the returned function is called.
+func (a *Archiver) scope(tx *sql.Tx) func() {
+	return a.stmts.scope(tx)
+}
+
+// prepare returns a statement for query prepared on tx, cached while tx is in scope.
+// The statement must not be closed.
+func (a *Archiver) prepare(tx *sql.Tx, query string) (*sql.Stmt, error) {
+	return a.stmts.prepare(tx, query)
+}
+
+// exec executes a query on tx with a cached prepared statement,
+// or without preparing it if tx is not in scope.
+func (a *Archiver) exec(tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	if !a.stmts.inScope(tx) {
+		return tx.Exec(query, args...)
+	}
+	smt, err := a.prepare(tx, query)
+	if err != nil {
+		return nil, err
+	}
+	return smt.Exec(args...)
+}
+
+// insertRows inserts rows into the columns of table with multi-row inserts of
+// as many rows as fit in maxBatchParams parameters. suffix is appended to each
+// statement, such as an ON CONFLICT clause.
+func (a *Archiver) insertRows(tx *sql.Tx, table, columns, suffix string, rows [][]interface{}) error {
+	ncols := len(strings.Split(columns, ", "))
+	batch := maxBatchParams / ncols
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", ncols), ", ") + ")"
+
+	for len(rows) > 0 {
+		n := batch
+		if n > len(rows) {
+			n = len(rows)
+		}
+
+		query := "INSERT INTO " + table + "(" + columns + ") VALUES" +
+			strings.TrimSuffix(strings.Repeat(placeholders+", ", n), ", ")
+		if suffix != "" {
+			query += " " + suffix
+		}
+
+		args := make([]interface{}, 0, n*ncols)
+		for _, row := range rows[:n] {
+			args = append(args, row...)
+		}
+		if _, err := a.exec(tx, query, args...); err != nil {
+			return err
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package discordarchive
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestStmtCacheKeepsLiveTx checks that statements of a transaction stay usable
+// while other transactions come and go, until its scope ends.
+func TestStmtCacheKeepsLiveTx(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "archive.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec("CREATE TABLE t (v INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+
+	a := New()
+	defer a.Close()
+
+	live, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := a.scope(live)
+	smt, err := a.prepare(live, "INSERT INTO t (v) VALUES (?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other transactions, such as those of watched events, are used in between.
+	for i := 0; i < 10; i++ {
+		if _, err = smt.Exec(i); err != nil {
+			t.Fatalf("statement of a live transaction failed after %d other transactions: %s", i, err)
+		}
+
+		other, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		end := a.scope(other)
+		if _, err = a.exec(other, "SELECT count(*) FROM t"); err != nil {
+			t.Fatal(err)
+		}
+		other.Rollback()
+		end()
+	}
+
+	if err = live.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if len(a.stmts.txs) != 0 {
+		t.Fatalf("%d transactions are still cached after their scope ended", len(a.stmts.txs))
+	}
+}
+
+// TestStmtCacheCallerTx checks that methods taking a transaction of the caller
+// do not keep its statements once they return.
+func TestStmtCacheCallerTx(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "archive.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	a := New()
+	defer a.Close()
+
+	for _, page := range syntheticPages(3) {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = a.InitDB(tx, nil)
+		if err == nil {
+			err = a.InsertMessages(tx, page)
+		}
+		if err == nil {
+			err = a.InsertRoles(tx, "2", []*discordgo.Role{{ID: "3", Name: "role"}})
+		}
+		if err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+		if err = tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(a.stmts.txs) != 0 {
+		t.Fatalf("%d committed transactions are still cached", len(a.stmts.txs))
+	}
+}
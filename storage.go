@@ -0,0 +1,148 @@
+package discordarchive
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Storage stores downloaded files.
+// Paths are slash separated and relative to the root of the storage,
+// as they are recorded in the database.
+type Storage interface {
+	// Put stores the contents of r at path, replacing any file already
+	// stored there, and returns the number of bytes stored.
+	Put(path string, r io.Reader) (int64, error)
+
+	// Exists reports whether a file is stored at path.
+	Exists(path string) (bool, error)
+
+	// Open opens the file stored at path for reading.
+	Open(path string) (io.ReadCloser, error)
+
+	// URL returns the location to link to the file stored at path, which is
+	// either an absolute URL or a path on the local filesystem. It returns
+	// an empty string if the file can only be read with Open.
+	URL(path string) string
+}
+
+// OpenStorage opens the storage described by spec, which is one of
+//
+//	tar:<path>                 a tar bundle, see OpenTarStorage
+//	s3://<bucket>[/<prefix>]   an S3 compatible bucket, see NewS3Storage
+//	<path>                     a folder on the local filesystem
+//
+// S3 buckets accept the query parameters endpoint and region, such as
+// s3://media/archive?endpoint=http://localhost:9000. Their credentials are
+// read from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+func OpenStorage(spec string) (Storage, error) {
+	switch {
+	case strings.HasPrefix(spec, "tar:"):
+		return OpenTarStorage(strings.TrimPrefix(spec, "tar:"))
+
+	case strings.HasPrefix(spec, "s3://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, errors.New("error, missing bucket in storage " + spec)
+		}
+		s := NewS3Storage(u.Query().Get("endpoint"), u.Host, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+		s.Prefix = strings.Trim(u.Path, "/")
+		if region := u.Query().Get("region"); region != "" {
+			s.Region = region
+		}
+		return s, nil
+
+	default:
+		return NewLocalStorage(spec), nil
+	}
+}
+
+// LocalStorage stores files in a folder on the local filesystem.
+type LocalStorage struct {
+	// Root is the folder files are stored in.
+	// If the folder does not exist, it is created when a file is stored.
+	Root string
+}
+
+// NewLocalStorage returns a storage that keeps files in the folder root.
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{Root: root}
+}
+
+func (s *LocalStorage) path(pathA string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(pathA))
+}
+
+// Put writes r to a temporary file next to path, and renames it
+// into place once it has been written completely.
+func (s *LocalStorage) Put(pathA string, r io.Reader) (int64, error) {
+	path := s.path(pathA)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	tmp.Close()
+	if err != nil {
+		return n, err
+	}
+
+	return n, os.Rename(tmp.Name(), path)
+}
+
+// Exists ...
+func (s *LocalStorage) Exists(pathA string) (bool, error) {
+	_, err := os.Stat(s.path(pathA))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Open ...
+func (s *LocalStorage) Open(pathA string) (io.ReadCloser, error) {
+	return os.Open(s.path(pathA))
+}
+
+// URL returns the path of the file on the local filesystem.
+func (s *LocalStorage) URL(pathA string) string {
+	return s.path(pathA)
+}
+
+// spool copies r into a temporary file, so that its size is known before
+// it is stored. The file is positioned at its start, and must be closed and
+// removed by the caller.
+func spool(r io.Reader, w io.Writer) (*os.File, int64, error) {
+	tmp, err := os.CreateTemp("", "discordarchive-*")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dst := io.Writer(tmp)
+	if w != nil {
+		dst = io.MultiWriter(tmp, w)
+	}
+	n, err := io.Copy(dst, r)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, n, err
+	}
+	return tmp, n, nil
+}
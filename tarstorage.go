@@ -0,0 +1,187 @@
+package discordarchive
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// TarStorage stores files in a single tar bundle.
+// Files are appended to the end of the bundle, and a file that is stored
+// again replaces the earlier copy when the bundle is extracted.
+// Files in a bundle can not be linked to, so URL always returns an empty string.
+type TarStorage struct {
+	mu sync.Mutex
+	f  *os.File
+
+	// end is the offset of the end of the last file in the bundle,
+	// where the next file is written.
+	end int64
+
+	// files maps the path of every file in the bundle to its contents.
+	files map[string]tarEntry
+}
+
+// tarEntry is the location of the contents of a file in a tar bundle.
+type tarEntry struct {
+	offset int64
+	size   int64
+}
+
+// countingReader counts the bytes read from a reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// OpenTarStorage opens the tar bundle at path, creating it if it does not exist.
+// A bundle that was not closed properly is truncated after its last complete file.
+// The storage must be closed when it is no longer used.
+func OpenTarStorage(path string) (*TarStorage, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &TarStorage{f: f, files: map[string]tarEntry{}}
+
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			// The rest of the bundle is either its end, or a file that was not
+			// written completely and is overwritten by the next file.
+			break
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		entry := tarEntry{offset: cr.n, size: hdr.Size}
+		if entry.offset+entry.size > s.fileSize() {
+			break
+		}
+		s.files[hdr.Name] = entry
+		s.end = entry.offset + (entry.size+511)/512*512
+	}
+
+	return s, nil
+}
+
+func (s *TarStorage) fileSize() int64 {
+	info, err := s.f.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Put appends a file to the end of the bundle.
+func (s *TarStorage) Put(path string, r io.Reader) (int64, error) {
+	// The size of a file is written before its contents.
+	tmp, n, err := spool(r, nil)
+	if err != nil {
+		return n, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return 0, ErrClosed
+	}
+
+	_, err = s.f.Seek(s.end, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	tw := tar.NewWriter(s.f)
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path,
+		Mode:     0644,
+		Size:     n,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	offset, err := s.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = io.Copy(tw, tmp); err != nil {
+		return 0, err
+	}
+	if err = tw.Flush(); err != nil {
+		return 0, err
+	}
+	end, err := s.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	// Close writes the end of the bundle, which is overwritten by the next file.
+	if err = tw.Close(); err != nil {
+		return 0, err
+	}
+
+	s.files[path] = tarEntry{offset: offset, size: n}
+	s.end = end
+	return n, nil
+}
+
+// Exists ...
+func (s *TarStorage) Exists(path string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.files[path]
+	return ok, nil
+}
+
+// Open ...
+func (s *TarStorage) Open(path string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil, ErrClosed
+	}
+	entry, ok := s.files[path]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return io.NopCloser(io.NewSectionReader(s.f, entry.offset, entry.size)), nil
+}
+
+// URL returns an empty string, as files in a bundle can only be read with Open.
+func (s *TarStorage) URL(path string) string {
+	return ""
+}
+
+// Close closes the bundle.
+func (s *TarStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return errors.New("error, tar storage is already closed")
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
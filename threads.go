@@ -0,0 +1,289 @@
+package discordarchive
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// hasThreads reports whether threads can be created in a channel.
+func hasThreads(channel *discordgo.Channel) bool {
+	return channel.Type == discordgo.ChannelTypeGuildText ||
+		channel.Type == discordgo.ChannelTypeGuildNews
+}
+
+// isForum reports whether a channel is made up of posts.
+func isForum(channel *discordgo.Channel) bool {
+	return channel.Type == discordgo.ChannelTypeGuildForum ||
+		channel.Type == discordgo.ChannelTypeGuildMedia
+}
+
+// ChannelThreads returns the active, public archived and private archived
+// threads of a channel. Private archived threads are skipped if the
+// session does not have permission to list them.
+func (a *Archiver) ChannelThreads(s DiscordClient, channel *discordgo.Channel) ([]*discordgo.Channel, error) {
+	return a.channelThreads(context.Background(), s, &activeThreads{}, channel)
+}
+
+// activeThreads lists the active threads of a guild once, as they can only
+// be listed for a whole guild, and shares them among its channels.
+// It is safe for concurrent use.
+type activeThreads struct {
+	once     sync.Once
+	byParent map[string][]*discordgo.Channel
+	err      error
+}
+
+// get returns the active threads of a channel, listing those of its guild
+// the first time it is called.
+func (t *activeThreads) get(ctx context.Context, tc threadClient, channel *discordgo.Channel) ([]*discordgo.Channel, error) {
+	t.once.Do(func() {
+		active, err := tc.GuildThreadsActive(channel.GuildID, discordgo.WithContext(ctx))
+		if err != nil {
+			t.err = requestErr(ctx, err)
+			return
+		}
+		t.byParent = map[string][]*discordgo.Channel{}
+		for _, thread := range active.Threads {
+			t.byParent[thread.ParentID] = append(t.byParent[thread.ParentID], thread)
+		}
+	})
+	return t.byParent[channel.ID], t.err
+}
+
+func (a *Archiver) channelThreads(ctx context.Context, s DiscordClient, active *activeThreads, channel *discordgo.Channel) ([]*discordgo.Channel, error) {
+	tc, ok := s.(threadClient)
+	if !ok {
+		return nil, ErrUnsupportedClient
+	}
+
+	var (
+		threads []*discordgo.Channel
+		seen    = map[string]bool{}
+	)
+	add := func(list []*discordgo.Channel) {
+		for _, t := range list {
+			if t.ParentID == channel.ID && !seen[t.ID] {
+				seen[t.ID] = true
+				threads = append(threads, t)
+			}
+		}
+	}
+
+	list, err := active.get(ctx, tc, channel)
+	if err != nil {
+		return nil, err
+	}
+	add(list)
+
+	public, err := archivedThreads(ctx, tc.ThreadsArchived, channel.ID)
+	if err != nil {
+		return nil, requestErr(ctx, err)
+	}
+	add(public)
+
+	// Forum posts cannot be private.
+	if !isForum(channel) {
+		private, err := archivedThreads(ctx, tc.ThreadsPrivateArchived, channel.ID)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err != nil {
+			a.logf("[error] error listing private archived threads in channel [%s]: %s", channel.Name, err.Error())
+		}
+		add(private)
+	}
+
+	return threads, nil
+}
+
+// archivedThreads pages through one of the archived threads endpoints.
+func archivedThreads(ctx context.Context, list func(channelID string, before *time.Time, limit int, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error), channelID string) ([]*discordgo.Channel, error) {
+	var (
+		threads []*discordgo.Channel
+		before  *time.Time
+	)
+	for {
+		res, err := list(channelID, before, 100, discordgo.WithContext(ctx))
+		if err != nil {
+			return threads, err
+		}
+		threads = append(threads, res.Threads...)
+		if !res.HasMore || len(res.Threads) == 0 {
+			return threads, nil
+		}
+
+		last := res.Threads[len(res.Threads)-1]
+		if last.ThreadMetadata == nil {
+			return threads, nil
+		}
+		t := last.ThreadMetadata.ArchiveTimestamp
+		before = &t
+	}
+}
+
+// ArchiveThreads archives the messages of every thread in a channel.
+// Threads that fail to archive do not stop the rest from being archived;
+// their errors are returned together as ChannelErrors.
+// The files downloaded from the threads are recorded in tx before it returns.
+func (a *Archiver) ArchiveThreads(s DiscordClient, tx *sql.Tx, channel *discordgo.Channel, opt *Options) error {
+	sink := a.sqlSink(tx)
+	defer sink.Close()
+	return a.archiveThreads(context.Background(), s, sink, &activeThreads{}, channel, opt)
+}
+
+func (a *Archiver) archiveThreads(ctx context.Context, s DiscordClient, sink Sink, active *activeThreads, channel *discordgo.Channel, opt *Options) error {
+	threads, err := a.channelThreads(ctx, s, active, channel)
+	if err != nil {
+		return err
+	}
+
+	var errs ChannelErrors
+	for _, thread := range threads {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		a.logf("[info] archiving thread [%s] in channel [%s]", thread.Name, channel.Name)
+
+		err = sink.PutChannel(thread)
+		if err != nil {
+			return err
+		}
+
+		err = a.archiveMessages(ctx, s, sink, thread.GuildID, thread, opt)
+		if ctx.Err() != nil {
+			return err
+		}
+		if err != nil {
+			errs = append(errs, &ChannelError{ChannelID: thread.ID, ChannelName: thread.Name, Err: err})
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// ArchiveForumPosts archives the posts of a forum or media channel.
+// Each post is archived as a thread along with its tags and starter message.
+// The errors of posts that fail to archive are returned together as ChannelErrors.
+// The files downloaded from the posts are recorded in tx before it returns.
+func (a *Archiver) ArchiveForumPosts(s DiscordClient, tx *sql.Tx, forum *discordgo.Channel, opt *Options) error {
+	sink := a.sqlSink(tx)
+	defer sink.Close()
+	return a.archiveForumPosts(context.Background(), s, sink, &activeThreads{}, forum, opt)
+}
+
+func (a *Archiver) archiveForumPosts(ctx context.Context, s DiscordClient, sink Sink, active *activeThreads, forum *discordgo.Channel, opt *Options) error {
+	posts, err := a.channelThreads(ctx, s, active, forum)
+	if err != nil {
+		return err
+	}
+
+	var errs ChannelErrors
+	sq, isSQL := sink.(*SQLSink)
+	for _, post := range posts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		a.logf("[info] archiving post [%s] in forum [%s]", post.Name, forum.Name)
+
+		err = sink.PutChannel(post)
+		if err != nil {
+			return err
+		}
+		if isSQL {
+			err = sq.w.do(func(tx *sql.Tx) error {
+				return a.InsertForumTags(tx, post, forum)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		err = a.archiveMessages(ctx, s, sink, post.GuildID, post, opt)
+		if ctx.Err() != nil {
+			return err
+		}
+		if err != nil {
+			errs = append(errs, &ChannelError{ChannelID: post.ID, ChannelName: post.Name, Err: err})
+			continue
+		}
+
+		// Only an SQLSink can tell whether the starter message was archived.
+		if !isSQL {
+			continue
+		}
+		err = a.archiveStarterMessage(ctx, s, sq, post)
+		if ctx.Err() != nil {
+			return err
+		}
+		if err != nil {
+			errs = append(errs, &ChannelError{ChannelID: post.ID, ChannelName: post.Name, Err: err})
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// InsertForumTags stores the tags applied to a forum post.
+// Tags are resolved against the forum's available tags so they are kept
+// even if the tag is later removed from the forum.
+func (a *Archiver) InsertForumTags(tx *sql.Tx, post, forum *discordgo.Channel) error {
+	tags := []discordgo.ForumTag{}
+	for _, id := range post.AppliedTags {
+		for _, t := range forum.AvailableTags {
+			if t.ID == id {
+				tags = append(tags, t)
+			}
+		}
+	}
+
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE channels SET tagsJSON=? WHERE channelID=?", string(tagsJSON), post.ID)
+	return err
+}
+
+// archiveStarterMessage makes sure the first message of a forum post is
+// archived, even if the post's history was cut short by opt.Limit.
+// The starter message shares its ID with the post.
+func (a *Archiver) archiveStarterMessage(ctx context.Context, s DiscordClient, sink *SQLSink, post *discordgo.Channel) error {
+	var n int
+	err := sink.w.do(func(tx *sql.Tx) error {
+		return tx.QueryRow("SELECT count(*) FROM messages WHERE channelID=? AND messageID=?", post.ID, post.ID).Scan(&n)
+	})
+	if err != nil || n > 0 {
+		return err
+	}
+
+	mc, ok := s.(messageClient)
+	if !ok {
+		return nil
+	}
+
+	msg, err := mc.ChannelMessage(post.ID, post.ID, discordgo.WithContext(ctx))
+	if restErr, ok := err.(*discordgo.RESTError); ok && restErr.Message != nil &&
+		restErr.Message.Code == discordgo.ErrCodeUnknownMessage {
+		// The starter message was deleted.
+		return nil
+	}
+	if err != nil {
+		return requestErr(ctx, err)
+	}
+
+	return sink.w.do(func(tx *sql.Tx) error {
+		return a.InsertMessages(tx, []*discordgo.Message{msg})
+	})
+}
@@ -1,7 +1,12 @@
 package discordarchive
 
 import (
+	"context"
+	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -12,7 +17,7 @@ var (
 )
 
 // returns the nth message from a channel
-func nthChannelMessage(s *discordgo.Session, channelID string, n int) (*discordgo.Message, error) {
+func nthChannelMessage(ctx context.Context, s DiscordClient, channelID string, n int) (*discordgo.Message, error) {
 	toSkip := n
 
 	var beforeID string
@@ -21,9 +26,9 @@ func nthChannelMessage(s *discordgo.Session, channelID string, n int) (*discordg
 		if fetchnum > 100 {
 			fetchnum = 100
 		}
-		msgs, err := s.ChannelMessages(channelID, fetchnum, beforeID, "", "")
+		msgs, err := s.ChannelMessages(channelID, fetchnum, beforeID, "", "", discordgo.WithContext(ctx))
 		if err != nil {
-			return nil, err
+			return nil, requestErr(ctx, err)
 		}
 		if len(msgs) == 0 {
 			return nil, ErrEmpty
@@ -39,7 +44,7 @@ func nthChannelMessage(s *discordgo.Session, channelID string, n int) (*discordg
 
 }
 
-func nthGuildMember(s *discordgo.Session, guildID string, n int) (*discordgo.Member, error) {
+func nthGuildMember(ctx context.Context, s DiscordClient, guildID string, n int) (*discordgo.Member, error) {
 	toSkip := n
 
 	var lastID string
@@ -48,9 +53,9 @@ func nthGuildMember(s *discordgo.Session, guildID string, n int) (*discordgo.Mem
 		if fetchnum > 1000 {
 			fetchnum = 1000
 		}
-		usrs, err := s.GuildMembers(guildID, lastID, fetchnum)
+		usrs, err := s.GuildMembers(guildID, lastID, fetchnum, discordgo.WithContext(ctx))
 		if err != nil {
-			return nil, err
+			return nil, requestErr(ctx, err)
 		}
 		if len(usrs) == 0 {
 			return nil, ErrEmpty
@@ -64,3 +69,101 @@ func nthGuildMember(s *discordgo.Session, guildID string, n int) (*discordgo.Mem
 		lastID = usrs[len(usrs)-1].User.ID
 	}
 }
+
+// requestErr returns the error of ctx if it is done, so that requests
+// interrupted by a cancellation return it instead of the error of the request.
+func requestErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// snowflakeLess reports whether snowflake a is older than snowflake b.
+// IDs are compared by length first so that no integer conversion is needed.
+func snowflakeLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// fetchCount returns the number of messages to request in the next page
+// when archived messages have already been stored. Returns 0 once the limit
+// has been reached.
+func fetchCount(limit, archived int) int {
+	if limit <= 0 {
+		return 100
+	}
+	n := limit - archived
+	if n > 100 {
+		n = 100
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+// TimestampFormat is the layout used to store timestamps in the database.
+// Timestamps are stored in UTC with a fixed precision so that they sort as text.
+// Discord sends timestamps with microseconds, so they are stored with microseconds.
+const TimestampFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(TimestampFormat)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// addColumns adds the given column definitions to a table if they are missing.
+// It reports whether any column was added.
+func (a *Archiver) addColumns(tx *sql.Tx, table string, columns ...string) (bool, error) {
+	rows, err := tx.Query(a.dialect().ColumnsQuery(table))
+	if err != nil {
+		return false, err
+	}
+
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return false, err
+		}
+		existing[strings.ToLower(name)] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+
+	var added bool
+	for _, def := range columns {
+		name := strings.Fields(def)[0]
+		if existing[strings.ToLower(name)] {
+			continue
+		}
+		if _, err = tx.Exec(a.dialect().Types(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, def))); err != nil {
+			return added, err
+		}
+		added = true
+	}
+
+	return added, nil
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
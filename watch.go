@@ -0,0 +1,389 @@
+package discordarchive
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// watcher archives gateway events as they are received.
+type watcher struct {
+	a   *Archiver
+	s   *discordgo.Session
+	db  *sql.DB
+	opt *Options
+
+	// ctx is canceled once watching stops, so that downloads are no longer retried.
+	ctx context.Context
+
+	// channels is the set of watched channels. If empty, every channel is watched.
+	channels map[string]bool
+
+	// files records the downloads queued by events in transactions of their
+	// own as they finish, so that events are not held up by slow downloads.
+	files *SQLSink
+
+	// mu serializes writes to the database.
+	mu sync.Mutex
+}
+
+// Watch archives messages as they are sent, edited and deleted, along with
+// changes to their reactions, by listening to events from the gateway.
+// New messages are inserted immediately. The previous version of an edited
+// message is stored in the message_revisions table, and deleted messages are
+// marked with a deleted_at tombstone instead of being removed.
+// If channelIDs are given, only those channels and their threads are watched.
+// The session must be opened for events to be received. Watch returns a
+// function that stops watching.
+func (a *Archiver) Watch(s *discordgo.Session, db *sql.DB, opt *Options, channelIDs ...string) (stop func(), err error) {
+	if opt == nil {
+		opt = NewOptions()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer a.scope(tx)()
+	err = a.InitDB(tx, opt)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &watcher{
+		a:        a,
+		s:        s,
+		db:       db,
+		opt:      opt,
+		ctx:      ctx,
+		channels: map[string]bool{},
+		files:    a.autocommitSink(db),
+	}
+	for _, id := range channelIDs {
+		w.channels[id] = true
+	}
+
+	removers := []func(){
+		s.AddHandler(w.messageCreate),
+		s.AddHandler(w.messageUpdate),
+		s.AddHandler(w.messageDelete),
+		s.AddHandler(w.messageDeleteBulk),
+		s.AddHandler(w.reactionAdd),
+		s.AddHandler(w.reactionRemove),
+		s.AddHandler(w.reactionRemoveAll),
+	}
+
+	return func() {
+		for _, remove := range removers {
+			remove()
+		}
+		cancel()
+		// Wait for the handler that is currently writing to finish.
+		w.mu.Lock()
+		w.mu.Unlock()
+	}, nil
+}
+
+// do runs fn in its own transaction, committing it if fn succeeds.
+func (w *watcher) do(event string, fn func(tx *sql.Tx) error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		w.a.logf("[error] error handling %s: %s", event, err.Error())
+		return
+	}
+	defer w.a.scope(tx)()
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		w.a.logf("[error] error handling %s: %s", event, err.Error())
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		w.a.logf("[error] error handling %s: %s", event, err.Error())
+	}
+}
+
+// channel returns a channel from the session state, or requests it
+// if it is not cached.
+func (w *watcher) channel(channelID string) (*discordgo.Channel, error) {
+	if ch, err := w.s.State.Channel(channelID); err == nil {
+		return ch, nil
+	}
+	return w.s.Channel(channelID)
+}
+
+// watching reports whether events in a channel should be archived.
+func (w *watcher) watching(channelID string) bool {
+	if len(w.channels) == 0 || w.channels[channelID] {
+		return true
+	}
+
+	// Threads are watched along with their parent channel.
+	ch, err := w.channel(channelID)
+	return err == nil && w.channels[ch.ParentID]
+}
+
+// ensureChannel stores the channel a message was sent in, and its guild,
+// if they have not been archived yet.
+func (w *watcher) ensureChannel(tx *sql.Tx, channelID string) error {
+	var exists int
+	err := tx.QueryRow("SELECT COUNT(*) FROM channels WHERE channelID=?", channelID).Scan(&exists)
+	if err != nil || exists != 0 {
+		return err
+	}
+
+	channel, err := w.channel(channelID)
+	if err != nil {
+		return err
+	}
+
+	err = w.a.InsertChannel(tx, channel)
+	if err != nil {
+		return err
+	}
+
+	if channel.GuildID == "" {
+		return w.a.InsertRecipients(tx, channel)
+	}
+
+	err = tx.QueryRow("SELECT COUNT(*) FROM guilds WHERE guildID=?", channel.GuildID).Scan(&exists)
+	if err != nil || exists != 0 {
+		return err
+	}
+
+	guild, err := w.s.State.Guild(channel.GuildID)
+	if err != nil {
+		guild, err = w.s.Guild(channel.GuildID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = w.a.insertGuildInfo(tx, guild)
+	if err != nil {
+		return err
+	}
+	return w.a.downloadGuildMedia(w.ctx, w.files.w, guild, w.opt)
+}
+
+// insertMessage inserts a message received from the gateway and downloads its files.
+// The archived range of the channel is left unchanged, so that messages
+// sent while not watching are still fetched by the next update.
+func (w *watcher) insertMessage(tx *sql.Tx, msg *discordgo.Message) error {
+	err := w.ensureChannel(tx, msg.ChannelID)
+	if err != nil {
+		return err
+	}
+
+	err = w.a.InsertMessages(tx, []*discordgo.Message{msg})
+	if err != nil {
+		return err
+	}
+
+	if w.opt.SaveAttachments {
+		err = w.a.downloadAttachments(w.ctx, w.files, msg, w.opt)
+		if err != nil {
+			return err
+		}
+	}
+	if w.opt.SaveEmbedImages {
+		err = w.a.downloadEmbeds(w.ctx, w.files, msg, w.opt)
+		if err != nil {
+			return err
+		}
+	}
+	if w.opt.SaveEmojis {
+		err = w.a.insertContentEmojis(tx, msg)
+		if err != nil {
+			return err
+		}
+		err = w.a.downloadMessageEmojis(w.ctx, w.files.w, msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *watcher) messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if !w.watching(m.ChannelID) {
+		return
+	}
+
+	w.do("message create", func(tx *sql.Tx) error {
+		stored, err := storedMessage(tx, m.ChannelID, m.ID)
+		if err != nil || stored != nil {
+			return err
+		}
+
+		w.a.logf("[info] new message [%s] in channel [%s]", m.ID, m.ChannelID)
+		return w.insertMessage(tx, m.Message)
+	})
+}
+
+func (w *watcher) messageUpdate(s *discordgo.Session, m *discordgo.MessageUpdate) {
+	if !w.watching(m.ChannelID) {
+		return
+	}
+
+	w.do("message update", func(tx *sql.Tx) error {
+		stored, err := storedMessage(tx, m.ChannelID, m.ID)
+		if err != nil {
+			return err
+		}
+
+		edited := m.Message
+		if edited.Author == nil {
+			// Updates that only resolve embeds do not contain the whole message,
+			// and are not edits.
+			if stored == nil {
+				return nil
+			}
+			merged := *stored
+			merged.Embeds = edited.Embeds
+			return w.a.updateMessageContent(tx, &merged)
+		}
+
+		if stored == nil {
+			return w.insertMessage(tx, edited)
+		}
+		if !messageChanged(stored, edited) {
+			return w.a.updateMessageContent(tx, edited)
+		}
+
+		w.a.logf("[info] message [%s] in channel [%s] was edited", m.ID, m.ChannelID)
+		return w.a.InsertRevision(tx, stored, edited, time.Now())
+	})
+}
+
+func (w *watcher) messageDelete(s *discordgo.Session, m *discordgo.MessageDelete) {
+	if !w.watching(m.ChannelID) {
+		return
+	}
+
+	w.do("message delete", func(tx *sql.Tx) error {
+		w.a.logf("[info] message [%s] in channel [%s] was deleted", m.ID, m.ChannelID)
+		return w.a.MarkDeleted(tx, m.ChannelID, m.ID, time.Now())
+	})
+}
+
+func (w *watcher) messageDeleteBulk(s *discordgo.Session, m *discordgo.MessageDeleteBulk) {
+	if !w.watching(m.ChannelID) {
+		return
+	}
+
+	w.do("bulk message delete", func(tx *sql.Tx) error {
+		w.a.logf("[info] [%d] messages in channel [%s] were deleted", len(m.Messages), m.ChannelID)
+		deletedAt := time.Now()
+		for _, id := range m.Messages {
+			err := w.a.MarkDeleted(tx, m.ChannelID, id, deletedAt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (w *watcher) reactionAdd(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	if !w.watching(r.ChannelID) {
+		return
+	}
+
+	w.do("reaction add", func(tx *sql.Tx) error {
+		stored, err := storedMessage(tx, r.ChannelID, r.MessageID)
+		if err != nil || stored == nil {
+			return err
+		}
+
+		// Events replayed after reconnecting must not count a user twice.
+		added, err := w.a.addReactionUser(tx, r.ChannelID, r.MessageID, &r.Emoji, r.UserID)
+		if err != nil || !added {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO reactions(channelID, messageID, emojiID, emojiName, animated, count) VALUES(?, ?, ?, ?, ?, 1) "+
+				"ON CONFLICT(channelID, messageID, emojiID, emojiName) DO UPDATE SET count=reactions.count+1",
+			r.ChannelID, r.MessageID, r.Emoji.ID, r.Emoji.Name, boolToInt(r.Emoji.Animated),
+		)
+		return err
+	})
+}
+
+func (w *watcher) reactionRemove(s *discordgo.Session, r *discordgo.MessageReactionRemove) {
+	if !w.watching(r.ChannelID) {
+		return
+	}
+
+	w.do("reaction remove", func(tx *sql.Tx) error {
+		res, err := tx.Exec(
+			"DELETE FROM reaction_users WHERE channelID=? AND messageID=? AND emojiID=? AND emojiName=? AND userID=?",
+			r.ChannelID, r.MessageID, r.Emoji.ID, r.Emoji.Name, r.UserID,
+		)
+		if err != nil {
+			return err
+		}
+		removed, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		// A user who was not recorded is only counted if the reaction was
+		// archived without its users. Otherwise the event is a replay.
+		if removed == 0 {
+			var users int
+			err = tx.QueryRow(
+				"SELECT count(*) FROM reaction_users WHERE channelID=? AND messageID=? AND emojiID=? AND emojiName=?",
+				r.ChannelID, r.MessageID, r.Emoji.ID, r.Emoji.Name,
+			).Scan(&users)
+			if err != nil || users > 0 {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(
+			"UPDATE reactions SET count=count-1 WHERE channelID=? AND messageID=? AND emojiID=? AND emojiName=?",
+			r.ChannelID, r.MessageID, r.Emoji.ID, r.Emoji.Name,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"DELETE FROM reactions WHERE channelID=? AND messageID=? AND emojiID=? AND emojiName=? AND count<=0",
+			r.ChannelID, r.MessageID, r.Emoji.ID, r.Emoji.Name,
+		)
+		return err
+	})
+}
+
+func (w *watcher) reactionRemoveAll(s *discordgo.Session, r *discordgo.MessageReactionRemoveAll) {
+	if !w.watching(r.ChannelID) {
+		return
+	}
+
+	w.do("reaction remove all", func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM reactions WHERE channelID=? AND messageID=?", r.ChannelID, r.MessageID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM reaction_users WHERE channelID=? AND messageID=?", r.ChannelID, r.MessageID)
+		return err
+	})
+}
@@ -0,0 +1,143 @@
+package discordarchive
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testWatcher returns a watcher of every channel, with a stored channel and message.
+func testWatcher(t *testing.T, opt *Options) (*watcher, *discordgo.Message) {
+	db := openTestDB(t)
+	a := New()
+	a.SavePath = t.TempDir()
+	t.Cleanup(func() { a.Close() })
+
+	msg := &discordgo.Message{ID: "175928847299117063", ChannelID: "81384788765712385", Author: &discordgo.User{ID: "80351110224678912"}}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.InitDB(tx, opt)
+	if err == nil {
+		err = a.InsertChannel(tx, &discordgo.Channel{ID: msg.ChannelID, Name: "general"})
+	}
+	if err == nil {
+		err = a.InsertMessages(tx, []*discordgo.Message{msg})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &watcher{a: a, db: db, opt: opt, ctx: context.Background(), channels: map[string]bool{}, files: a.autocommitSink(db)}, msg
+}
+
+func TestWatchReactionsIdempotent(t *testing.T) {
+	w, msg := testWatcher(t, NewOptions())
+	add := &discordgo.MessageReactionAdd{MessageReaction: &discordgo.MessageReaction{
+		UserID: "80351110224678913", ChannelID: msg.ChannelID, MessageID: msg.ID, Emoji: discordgo.Emoji{Name: "👍"},
+	}}
+	count := func() int {
+		var n int
+		err := w.db.QueryRow("SELECT COALESCE(SUM(count), 0) FROM reactions WHERE messageID=?", msg.ID).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// Events are replayed when the gateway resumes.
+	w.reactionAdd(nil, add)
+	w.reactionAdd(nil, add)
+	if n := count(); n != 1 {
+		t.Fatalf("got %d reactions after a replayed add, want 1", n)
+	}
+
+	other := *add.MessageReaction
+	other.UserID = "80351110224678914"
+	w.reactionAdd(nil, &discordgo.MessageReactionAdd{MessageReaction: &other})
+	if n := count(); n != 2 {
+		t.Fatalf("got %d reactions after another user reacted, want 2", n)
+	}
+
+	remove := &discordgo.MessageReactionRemove{MessageReaction: add.MessageReaction}
+	w.reactionRemove(nil, remove)
+	w.reactionRemove(nil, remove)
+	if n := count(); n != 1 {
+		t.Fatalf("got %d reactions after a replayed remove, want 1", n)
+	}
+}
+
+func TestWatchReplayedUpdate(t *testing.T) {
+	w, msg := testWatcher(t, NewOptions())
+
+	editedAt := time.Date(2021, 6, 1, 14, 32, 46, 104497000, time.UTC)
+	edited := *msg
+	edited.Content = "edited"
+	edited.EditedTimestamp = &editedAt
+	update := &discordgo.MessageUpdate{Message: &edited}
+
+	// Events are replayed when the gateway resumes, and embeds
+	// are resolved in updates without the rest of the message.
+	w.messageUpdate(nil, update)
+	w.messageUpdate(nil, update)
+	w.messageUpdate(nil, &discordgo.MessageUpdate{Message: &discordgo.Message{
+		ID: msg.ID, ChannelID: msg.ChannelID, Embeds: []*discordgo.MessageEmbed{{Title: "embed"}},
+	}})
+	w.messageUpdate(nil, update)
+
+	expectCount(t, w.db, 1, "SELECT count(*) FROM message_revisions WHERE messageID=?", msg.ID)
+	expectCount(t, w.db, 1, "SELECT count(*) FROM messages WHERE messageID=? AND content='edited'", msg.ID)
+}
+
+func TestWatchDoesNotWaitForDownloads(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	}))
+	defer srv.Close()
+
+	opt := NewOptions()
+	opt.SaveAttachments = true
+	w, stored := testWatcher(t, opt)
+
+	msg := &discordgo.Message{
+		ID:        "175928847299117064",
+		ChannelID: stored.ChannelID,
+		Author:    stored.Author,
+		Attachments: []*discordgo.MessageAttachment{{
+			ID: "175928847299117064", URL: srv.URL + "/image.png", Filename: "image.png",
+		}},
+	}
+	w.messageCreate(nil, &discordgo.MessageCreate{Message: msg})
+
+	// The event was committed while its attachment is still downloading.
+	if m, err := Message(w.db, msg.ChannelID, msg.ID); err != nil || m == nil {
+		t.Fatalf("message was not committed before its download finished: %v", err)
+	}
+
+	close(release)
+	w.a.Wait()
+
+	var path sql.NullString
+	err := w.db.QueryRow("SELECT path FROM files WHERE messageID=?", msg.ID).Scan(&path)
+	if err != nil || path.String == "" {
+		t.Fatalf("downloaded attachment was not recorded: %v", err)
+	}
+	var status string
+	err = w.db.QueryRow("SELECT status FROM downloads WHERE id=?", msg.ID).Scan(&status)
+	if err != nil || status != DownloadDone {
+		t.Fatalf("got download status %q, want %q: %v", status, DownloadDone, err)
+	}
+}
@@ -0,0 +1,270 @@
+package discordarchive
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// txWriter serializes the writes made to a transaction by channel workers
+// and downloads. Writes are run one at a time by the calling goroutine, or
+// by a single goroutine while one is started with start.
+// Functions passed to do must not call do themselves or queue downloads.
+//
+// The transaction of a sink that owns its transactions is replaced by swap
+// whenever it is committed, once the downloads recorded in it have finished.
+type txWriter struct {
+	tx *sql.Tx
+
+	// db is set for writers that run each write in a transaction of its own.
+	db *sql.DB
+
+	// exec is held while a write runs.
+	exec sync.Mutex
+
+	// mu guards ops, done, users and swapping. users counts the
+	// downloads recorded in tx, and cond is signaled when it changes.
+	mu       sync.Mutex
+	cond     *sync.Cond
+	ops      chan writeOp
+	done     chan struct{}
+	users    int
+	swapping bool
+}
+
+// writeOp is a write waiting to be run by the writer goroutine.
+type writeOp struct {
+	fn  func(tx *sql.Tx) error
+	err chan error
+}
+
+// directWriter returns a writer for tx.
+func directWriter(tx *sql.Tx) *txWriter {
+	w := &txWriter{tx: tx}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// dbWriter returns a writer that runs each write in a transaction of its own, begun on db.
+func dbWriter(db *sql.DB) *txWriter {
+	w := &txWriter{db: db}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// start starts a goroutine that runs every write until the returned function
+// is called. It does nothing if a goroutine has already been started.
+func (w *txWriter) start() (stop func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ops != nil {
+		return func() {}
+	}
+
+	ops, done, stopped := make(chan writeOp), make(chan struct{}), make(chan struct{})
+	w.ops, w.done = ops, done
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case op := <-ops:
+				op.err <- w.run(op.fn)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		w.mu.Lock()
+		w.ops, w.done = nil, nil
+		w.mu.Unlock()
+		close(done)
+		<-stopped
+	}
+}
+
+// do runs fn with the transaction and returns its error.
+func (w *txWriter) do(fn func(tx *sql.Tx) error) error {
+	w.mu.Lock()
+	ops, done := w.ops, w.done
+	w.mu.Unlock()
+
+	if ops != nil {
+		op := writeOp{fn: fn, err: make(chan error, 1)}
+		select {
+		case ops <- op:
+			return <-op.err
+		case <-done:
+		}
+	}
+	return w.run(fn)
+}
+
+// run runs a write once no other write is running.
+func (w *txWriter) run(fn func(tx *sql.Tx) error) error {
+	w.exec.Lock()
+	defer w.exec.Unlock()
+
+	if w.db == nil {
+		return fn(w.tx)
+	}
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// hold keeps the transaction from being swapped until the returned function
+// is called, such as while a download recorded in it runs. It waits for the
+// transaction being swapped, if any, to be replaced first.
+func (w *txWriter) hold() (release func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.swapping {
+		w.cond.Wait()
+	}
+	w.users++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			w.mu.Lock()
+			w.users--
+			w.cond.Broadcast()
+			w.mu.Unlock()
+		})
+	}
+}
+
+// wait waits until the transaction is no longer held by downloads.
+func (w *txWriter) wait() {
+	w.mu.Lock()
+	for w.users > 0 {
+		w.cond.Wait()
+	}
+	w.mu.Unlock()
+}
+
+// swap waits until the transaction is no longer held, then runs fn as a write
+// and replaces the transaction with the one fn returns.
+// It must not be called from a function passed to do.
+func (w *txWriter) swap(fn func(tx *sql.Tx) (*sql.Tx, error)) error {
+	w.mu.Lock()
+	for w.swapping {
+		w.cond.Wait()
+	}
+	w.swapping = true
+	for w.users > 0 {
+		w.cond.Wait()
+	}
+	w.mu.Unlock()
+
+	defer func() {
+		w.mu.Lock()
+		w.swapping = false
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}()
+
+	return w.do(func(tx *sql.Tx) error {
+		next, err := fn(tx)
+		if err != nil {
+			return err
+		}
+		w.tx = next
+		return nil
+	})
+}
+
+// ChannelError is an error that occurred while archiving a channel.
+type ChannelError struct {
+	ChannelID   string
+	ChannelName string
+	Err         error
+}
+
+func (e *ChannelError) Error() string {
+	return "error archiving channel [" + e.ChannelName + "] (" + e.ChannelID + "): " + e.Err.Error()
+}
+
+// ChannelErrors is returned by ArchiveGuild and ArchiveDirectMessages when some
+// of their channels or threads could not be archived. The rest are archived regardless.
+type ChannelErrors []*ChannelError
+
+func (e ChannelErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// archiveChannels archives the messages of channels in a guild using
+// opt.ChannelConcurrency workers. Messages are fetched concurrently,
+// but every write to the transaction of an SQLSink is made by a single
+// writer goroutine. Once ctx is done no more channels are started,
+// and the channels that were interrupted are not reported as errors.
+func (a *Archiver) archiveChannels(ctx context.Context, s DiscordClient, sink Sink, guild *discordgo.Guild, channels []*discordgo.Channel, opt *Options) ChannelErrors {
+	workers := opt.ChannelConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	if sq, ok := sink.(*SQLSink); ok && workers > 1 {
+		defer sq.w.start()()
+	}
+
+	var (
+		errs   ChannelErrors
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		jobs   = make(chan *discordgo.Channel)
+		active = &activeThreads{}
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for channel := range jobs {
+				a.logf("[info] archiving channel [%s] - [%s]", channel.Name, channel.Topic)
+				err := a.archiveChannel(ctx, s, sink, guild, active, channel, opt)
+				if err != nil && ctx.Err() == nil {
+					a.log("[error] error archiving channel: ", err)
+					mu.Lock()
+					// Threads that failed are reported on their own, rather than as their channel.
+					if threadErrs, ok := err.(ChannelErrors); ok {
+						errs = append(errs, threadErrs...)
+					} else {
+						errs = append(errs, &ChannelError{ChannelID: channel.ID, ChannelName: channel.Name, Err: err})
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+send:
+	for _, channel := range channels {
+		select {
+		case jobs <- channel:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return errs
+}